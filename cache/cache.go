@@ -0,0 +1,185 @@
+// Package cache is a typed cache-aside layer over a Store such as Redis:
+//
+//	users := cache.New[User](cache.NewRedisStore(r), cache.WithPrefix("user:"))
+//	u, err := users.GetOrLoad(ctx, id, func(ctx context.Context) (User, error) {
+//		return loadUser(ctx, id)
+//	}, 10*time.Minute)
+package cache
+
+import (
+	"context"
+	"github.com/akikistyle/caplibgo/db"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sync/singleflight"
+	"math/rand"
+	"time"
+)
+
+// ErrNotFound is returned for keys known not to exist. Loaders return it to
+// have the miss cached for the negative TTL.
+var ErrNotFound = errors.New("not found")
+
+// Every stored value starts with a kind byte, so a cached miss can not be
+// mistaken for a value whatever the codec.
+const (
+	kindValue    byte = 'v'
+	kindNotFound byte = 'n'
+)
+
+type options struct {
+	codec       Codec
+	prefix      string
+	negativeTTL time.Duration
+	jitter      float64
+	loadTimeout time.Duration
+}
+
+// Option configures a Cache.
+type Option func(*options)
+
+// WithCodec sets the codec, JSON by default.
+func WithCodec(c Codec) Option {
+	return func(o *options) { o.codec = c }
+}
+
+// WithPrefix puts prefix in front of every key.
+func WithPrefix(prefix string) Option {
+	return func(o *options) { o.prefix = prefix }
+}
+
+// WithNegativeTTL caches ErrNotFound from loaders for ttl. Zero, the
+// default, does not cache misses.
+func WithNegativeTTL(ttl time.Duration) Option {
+	return func(o *options) { o.negativeTTL = ttl }
+}
+
+// WithJitter spreads every ttl by up to +/- fraction of it, so keys written
+// together do not all expire together.
+func WithJitter(fraction float64) Option {
+	return func(o *options) { o.jitter = fraction }
+}
+
+// WithLoadTimeout bounds each loader call of GetOrLoad. Zero, the default,
+// leaves it unbounded.
+func WithLoadTimeout(d time.Duration) Option {
+	return func(o *options) { o.loadTimeout = d }
+}
+
+// Cache stores values of type T. It is safe for concurrent use.
+type Cache[T any] struct {
+	store Store
+	opts  options
+	group singleflight.Group
+}
+
+func New[T any](store Store, opts ...Option) *Cache[T] {
+	c := &Cache[T]{store: store, opts: options{codec: JSON}}
+	for _, opt := range opts {
+		opt(&c.opts)
+	}
+	return c
+}
+
+// Get returns the cached value of key. It returns db.ErrCacheMiss if the key
+// is not cached and ErrNotFound if a miss was cached.
+func (c *Cache[T]) Get(ctx context.Context, key string) (T, error) {
+	var zero T
+	data, err := c.store.Get(ctx, c.opts.prefix+key)
+	if err != nil {
+		return zero, err
+	}
+	return c.decode(data)
+}
+
+func (c *Cache[T]) decode(data []byte) (T, error) {
+	var v T
+	if len(data) == 0 {
+		return v, errors.New("cached value is empty")
+	}
+	switch data[0] {
+	case kindNotFound:
+		return v, ErrNotFound
+	case kindValue:
+		if err := c.opts.codec.Unmarshal(data[1:], &v); err != nil {
+			return v, errors.Wrap(err, "cached value can not be decoded")
+		}
+		return v, nil
+	}
+	return v, errors.Errorf("unknown cached value kind %q", data[0])
+}
+
+// Set caches val under key for ttl.
+func (c *Cache[T]) Set(ctx context.Context, key string, val T, ttl time.Duration) error {
+	data, err := c.opts.codec.Marshal(val)
+	if err != nil {
+		return errors.Wrap(err, "value can not be encoded")
+	}
+	return c.store.Set(ctx, c.opts.prefix+key, append([]byte{kindValue}, data...), c.jitter(ttl))
+}
+
+// Delete removes keys, including cached misses.
+func (c *Cache[T]) Delete(ctx context.Context, keys ...string) error {
+	full := make([]string, len(keys))
+	for i, key := range keys {
+		full[i] = c.opts.prefix + key
+	}
+	return c.store.Delete(ctx, full...)
+}
+
+// GetOrLoad returns the cached value of key, or calls loader and caches its
+// result for ttl. Concurrent calls for the same key share one loader call,
+// which is not cancelled with the ctx of any of them; a caller whose ctx is
+// done stops waiting and gets ctx.Err(). If the store fails the loader is
+// still used and the error only logged.
+func (c *Cache[T]) GetOrLoad(ctx context.Context, key string, loader func(ctx context.Context) (T, error), ttl time.Duration) (T, error) {
+	v, err := c.Get(ctx, key)
+	switch {
+	case err == nil || err == ErrNotFound:
+		return v, err
+	case err != db.ErrCacheMiss:
+		logrus.WithError(err).WithField("key", key).Warn("cache read failed")
+	}
+
+	ch := c.group.DoChan(key, func() (interface{}, error) {
+		ctx := context.WithoutCancel(ctx)
+		if c.opts.loadTimeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, c.opts.loadTimeout)
+			defer cancel()
+		}
+		v, err := loader(ctx)
+		switch {
+		case err == ErrNotFound && c.opts.negativeTTL > 0:
+			if serr := c.store.Set(ctx, c.opts.prefix+key, []byte{kindNotFound}, c.jitter(c.opts.negativeTTL)); serr != nil {
+				logrus.WithError(serr).WithField("key", key).Warn("cache write failed")
+			}
+		case err == nil:
+			if serr := c.Set(ctx, key, v, ttl); serr != nil {
+				logrus.WithError(serr).WithField("key", key).Warn("cache write failed")
+			}
+		}
+		return v, err
+	})
+	var zero T
+	select {
+	case res := <-ch:
+		if res.Err != nil {
+			return zero, res.Err
+		}
+		return res.Val.(T), nil
+	case <-ctx.Done():
+		return zero, ctx.Err()
+	}
+}
+
+func (c *Cache[T]) jitter(ttl time.Duration) time.Duration {
+	if ttl <= 0 || c.opts.jitter <= 0 {
+		return ttl
+	}
+	d := ttl + time.Duration(float64(ttl)*c.opts.jitter*(2*rand.Float64()-1))
+	if d <= 0 {
+		return ttl
+	}
+	return d
+}
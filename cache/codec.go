@@ -0,0 +1,111 @@
+package cache
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/gob"
+	"encoding/json"
+	"github.com/pkg/errors"
+	"github.com/vmihailenco/msgpack/v5"
+	"io/ioutil"
+)
+
+// Codec turns cached values into bytes and back.
+type Codec interface {
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+}
+
+var (
+	// JSON is the default codec.
+	JSON Codec = jsonCodec{}
+	// Gob only works with exported struct fields and types known to gob.
+	Gob Codec = gobCodec{}
+	// Msgpack is more compact and faster than JSON and honours `msgpack` tags.
+	Msgpack Codec = msgpackCodec{}
+)
+
+type jsonCodec struct{}
+
+func (jsonCodec) Marshal(v interface{}) ([]byte, error) { return json.Marshal(v) }
+
+func (jsonCodec) Unmarshal(data []byte, v interface{}) error { return json.Unmarshal(data, v) }
+
+type gobCodec struct{}
+
+func (gobCodec) Marshal(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (gobCodec) Unmarshal(data []byte, v interface{}) error {
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(v)
+}
+
+type msgpackCodec struct{}
+
+func (msgpackCodec) Marshal(v interface{}) ([]byte, error) { return msgpack.Marshal(v) }
+
+func (msgpackCodec) Unmarshal(data []byte, v interface{}) error { return msgpack.Unmarshal(data, v) }
+
+const (
+	rawFlag  byte = 0
+	gzipFlag byte = 1
+)
+
+// Compress gzips the output of c when it is at least minSize bytes long.
+// Smaller values are stored as they are, behind a one byte header.
+func Compress(c Codec, minSize int) Codec {
+	return compressCodec{c: c, minSize: minSize}
+}
+
+type compressCodec struct {
+	c       Codec
+	minSize int
+}
+
+func (cc compressCodec) Marshal(v interface{}) ([]byte, error) {
+	data, err := cc.c.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < cc.minSize {
+		return append([]byte{rawFlag}, data...), nil
+	}
+
+	var buf bytes.Buffer
+	buf.WriteByte(gzipFlag)
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write(data); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (cc compressCodec) Unmarshal(data []byte, v interface{}) error {
+	if len(data) == 0 {
+		return errors.New("compressed value is empty")
+	}
+	switch data[0] {
+	case rawFlag:
+		return cc.c.Unmarshal(data[1:], v)
+	case gzipFlag:
+		zr, err := gzip.NewReader(bytes.NewReader(data[1:]))
+		if err != nil {
+			return err
+		}
+		defer zr.Close()
+		raw, err := ioutil.ReadAll(zr)
+		if err != nil {
+			return err
+		}
+		return cc.c.Unmarshal(raw, v)
+	}
+	return errors.Errorf("unknown compression flag %d", data[0])
+}
@@ -0,0 +1,207 @@
+package cache
+
+import (
+	"container/heap"
+	"container/list"
+	"context"
+	"github.com/akikistyle/caplibgo/db"
+	"sync"
+	"time"
+)
+
+// EvictionPolicy picks the entry a full LocalStore drops.
+type EvictionPolicy int
+
+const (
+	// LRU drops the least recently used entry.
+	LRU EvictionPolicy = iota
+	// LFU drops the least frequently used entry, the least recently used
+	// among equals.
+	LFU
+)
+
+// LocalOptions limits a LocalStore. A limit of zero or less is no limit.
+type LocalOptions struct {
+	MaxEntries int
+	// MaxBytes bounds the total size of keys and values.
+	MaxBytes int
+	Policy   EvictionPolicy
+}
+
+// LocalStore is an in-process Store with a size limit and per-entry TTL. It
+// is safe for concurrent use. Values are copied in and out, so callers may
+// modify the slices they pass or get.
+type LocalStore struct {
+	opts LocalOptions
+
+	mu      sync.Mutex
+	entries map[string]*localEntry
+	bytes   int
+	evict   evictor
+	seq     uint64
+}
+
+type localEntry struct {
+	key     string
+	val     []byte
+	expires time.Time
+
+	// bookkeeping of the eviction policy
+	elem  *list.Element
+	index int
+	hits  uint64
+	seq   uint64
+}
+
+func (e *localEntry) size() int {
+	return len(e.key) + len(e.val)
+}
+
+func NewLocalStore(opts LocalOptions) *LocalStore {
+	s := &LocalStore{opts: opts, entries: make(map[string]*localEntry)}
+	if opts.Policy == LFU {
+		s.evict = &lfu{}
+	} else {
+		s.evict = &lru{l: list.New()}
+	}
+	return s
+}
+
+func (s *LocalStore) Get(ctx context.Context, key string) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, ok := s.entries[key]
+	if !ok {
+		return nil, db.ErrCacheMiss
+	}
+	if !e.expires.IsZero() && time.Now().After(e.expires) {
+		s.remove(e)
+		return nil, db.ErrCacheMiss
+	}
+	s.seq++
+	e.hits++
+	e.seq = s.seq
+	s.evict.touch(e)
+	return append([]byte(nil), e.val...), nil
+}
+
+func (s *LocalStore) Set(ctx context.Context, key string, val []byte, ttl time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if old, ok := s.entries[key]; ok {
+		s.remove(old)
+	}
+	e := &localEntry{key: key, val: append([]byte(nil), val...)}
+	if ttl > 0 {
+		e.expires = time.Now().Add(ttl)
+	}
+	if s.opts.MaxBytes > 0 && e.size() > s.opts.MaxBytes {
+		// would evict everything and still not fit
+		return nil
+	}
+	// make room first, so the new entry is never its own victim
+	for len(s.entries) > 0 && s.full(e.size()) {
+		s.remove(s.evict.victim())
+	}
+	s.seq++
+	e.hits, e.seq = 1, s.seq
+	s.entries[key] = e
+	s.bytes += e.size()
+	s.evict.add(e)
+	return nil
+}
+
+func (s *LocalStore) Delete(ctx context.Context, keys ...string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, key := range keys {
+		if e, ok := s.entries[key]; ok {
+			s.remove(e)
+		}
+	}
+	return nil
+}
+
+// Purge drops every entry.
+func (s *LocalStore) Purge() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, e := range s.entries {
+		s.remove(e)
+	}
+}
+
+// Len returns the number of entries, including expired ones not yet dropped.
+func (s *LocalStore) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.entries)
+}
+
+// full reports whether an entry of the given size does not fit.
+func (s *LocalStore) full(size int) bool {
+	return (s.opts.MaxEntries > 0 && len(s.entries) >= s.opts.MaxEntries) ||
+		(s.opts.MaxBytes > 0 && s.bytes+size > s.opts.MaxBytes)
+}
+
+func (s *LocalStore) remove(e *localEntry) {
+	delete(s.entries, e.key)
+	s.bytes -= e.size()
+	s.evict.remove(e)
+}
+
+type evictor interface {
+	add(e *localEntry)
+	touch(e *localEntry)
+	remove(e *localEntry)
+	victim() *localEntry
+}
+
+// lru keeps entries in a list, most recently used first.
+type lru struct {
+	l *list.List
+}
+
+func (p *lru) add(e *localEntry)    { e.elem = p.l.PushFront(e) }
+func (p *lru) touch(e *localEntry)  { p.l.MoveToFront(e.elem) }
+func (p *lru) remove(e *localEntry) { p.l.Remove(e.elem) }
+
+func (p *lru) victim() *localEntry {
+	return p.l.Back().Value.(*localEntry)
+}
+
+// lfu keeps entries in a min-heap by hit count, then by last use.
+type lfu []*localEntry
+
+func (h lfu) Len() int { return len(h) }
+
+func (h lfu) Less(i, j int) bool {
+	if h[i].hits != h[j].hits {
+		return h[i].hits < h[j].hits
+	}
+	return h[i].seq < h[j].seq
+}
+
+func (h lfu) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *lfu) Push(x interface{}) {
+	e := x.(*localEntry)
+	e.index = len(*h)
+	*h = append(*h, e)
+}
+
+func (h *lfu) Pop() interface{} {
+	old := *h
+	e := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return e
+}
+
+func (h *lfu) add(e *localEntry)    { heap.Push(h, e) }
+func (h *lfu) touch(e *localEntry)  { heap.Fix(h, e.index) }
+func (h *lfu) remove(e *localEntry) { heap.Remove(h, e.index) }
+func (h *lfu) victim() *localEntry  { return (*h)[0] }
@@ -0,0 +1,52 @@
+package cache
+
+import (
+	"context"
+	"github.com/akikistyle/caplibgo/db"
+	"github.com/garyburd/redigo/redis"
+	"time"
+)
+
+// Store keeps encoded values. Get reports a missing key as db.ErrCacheMiss.
+// A ttl of zero means no expiry.
+type Store interface {
+	Get(ctx context.Context, key string) ([]byte, error)
+	Set(ctx context.Context, key string, val []byte, ttl time.Duration) error
+	Delete(ctx context.Context, keys ...string) error
+}
+
+// RedisStore is a Store backed by db.Redis.
+type RedisStore struct {
+	R *db.Redis
+}
+
+func NewRedisStore(r *db.Redis) *RedisStore {
+	return &RedisStore{R: r}
+}
+
+func (s *RedisStore) Get(ctx context.Context, key string) ([]byte, error) {
+	b, err := redis.Bytes(s.R.Do(ctx, "GET", key))
+	if err == redis.ErrNil {
+		return nil, db.ErrCacheMiss
+	}
+	return b, err
+}
+
+func (s *RedisStore) Set(ctx context.Context, key string, val []byte, ttl time.Duration) error {
+	args := redis.Args{key, val}
+	if ttl > 0 {
+		args = args.Add("PX", db.Millis(ttl))
+	}
+	_, err := s.R.Do(ctx, "SET", args...)
+	return err
+}
+
+// Delete removes keys with one DEL each, pipelined, so it also works when
+// the keys live on different cluster nodes.
+func (s *RedisStore) Delete(ctx context.Context, keys ...string) error {
+	p := s.R.Pipeline()
+	for _, key := range keys {
+		p.Do("DEL", key)
+	}
+	return p.Exec(ctx)
+}
@@ -0,0 +1,168 @@
+package cache
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"github.com/akikistyle/caplibgo/db"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"sync"
+	"time"
+)
+
+// DefaultInvalidationChannel is the Pub/Sub channel Tiered stores use unless
+// TieredOptions.Channel is set.
+const DefaultInvalidationChannel = "cache:invalidate"
+
+// TieredOptions configures a Tiered store.
+type TieredOptions struct {
+	// LocalTTL caps how long a value stays in the local tier. It bounds the
+	// staleness if an invalidation is lost, e.g. while the subscription
+	// reconnects. Zero keeps values read from Redis until they are evicted
+	// or invalidated.
+	LocalTTL time.Duration
+	// Channel is the invalidation channel, DefaultInvalidationChannel by
+	// default. Every replica sharing the keys must use the same one.
+	Channel string
+}
+
+// Tiered is a Store keeping hot values in a LocalStore in front of Redis.
+// Writes and deletes go to Redis and are announced on a Pub/Sub channel, so
+// every other replica drops its local copy.
+//
+// Values read from Redis are kept locally for LocalTTL, since GET does not
+// tell their remaining ttl. The local tier is purged whenever the
+// subscription reconnects, as invalidations may have been missed.
+type Tiered struct {
+	Local  *LocalStore
+	Remote *RedisStore
+
+	opts TieredOptions
+	id   string
+	sub  *db.Subscription
+
+	// gen counts invalidations, so a value read from Redis is not kept
+	// locally if it may have changed while it was being read
+	mu  sync.Mutex
+	gen uint64
+}
+
+type invalidation struct {
+	From string   `json:"from"`
+	Keys []string `json:"keys"`
+}
+
+// NewTiered subscribes to the invalidation channel and returns the store.
+// Close it to end the subscription.
+func NewTiered(r *db.Redis, local *LocalStore, opts TieredOptions) (*Tiered, error) {
+	if opts.Channel == "" {
+		opts.Channel = DefaultInvalidationChannel
+	}
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return nil, errors.Wrap(err, "can not generate cache id")
+	}
+	t := &Tiered{Local: local, Remote: NewRedisStore(r), opts: opts, id: hex.EncodeToString(id)}
+
+	sub, err := r.Subscribe(context.Background(), opts.Channel)
+	if err != nil {
+		return nil, err
+	}
+	t.sub = sub
+	go t.listen()
+	return t, nil
+}
+
+func (t *Tiered) listen() {
+	for {
+		select {
+		case msg, ok := <-t.sub.C():
+			if !ok {
+				return
+			}
+			var inv invalidation
+			if err := json.Unmarshal(msg.Data, &inv); err != nil {
+				logrus.WithError(err).Warn("invalid cache invalidation message")
+				continue
+			}
+			if inv.From != t.id {
+				t.invalidate(inv.Keys...)
+			}
+		case <-t.sub.Reconnected():
+			t.mu.Lock()
+			t.gen++
+			t.Local.Purge()
+			t.mu.Unlock()
+		}
+	}
+}
+
+// invalidate drops keys from the local tier.
+func (t *Tiered) invalidate(keys ...string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.gen++
+	t.Local.Delete(context.Background(), keys...)
+}
+
+func (t *Tiered) Get(ctx context.Context, key string) ([]byte, error) {
+	if val, err := t.Local.Get(ctx, key); err == nil {
+		return val, nil
+	}
+	t.mu.Lock()
+	gen := t.gen
+	t.mu.Unlock()
+	val, err := t.Remote.Get(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	t.mu.Lock()
+	if t.gen == gen {
+		t.Local.Set(ctx, key, val, t.opts.LocalTTL)
+	}
+	t.mu.Unlock()
+	return val, nil
+}
+
+func (t *Tiered) Set(ctx context.Context, key string, val []byte, ttl time.Duration) error {
+	if err := t.Remote.Set(ctx, key, val, ttl); err != nil {
+		t.invalidate(key)
+		return err
+	}
+	t.mu.Lock()
+	t.gen++
+	t.Local.Set(ctx, key, val, t.localTTL(ttl))
+	t.mu.Unlock()
+	return t.publish(ctx, key)
+}
+
+func (t *Tiered) Delete(ctx context.Context, keys ...string) error {
+	t.invalidate(keys...)
+	if err := t.Remote.Delete(ctx, keys...); err != nil {
+		return err
+	}
+	return t.publish(ctx, keys...)
+}
+
+// Close ends the invalidation subscription. The local tier is left as is.
+func (t *Tiered) Close() error {
+	return t.sub.Close()
+}
+
+func (t *Tiered) localTTL(ttl time.Duration) time.Duration {
+	if t.opts.LocalTTL > 0 && (ttl <= 0 || ttl > t.opts.LocalTTL) {
+		return t.opts.LocalTTL
+	}
+	return ttl
+}
+
+func (t *Tiered) publish(ctx context.Context, keys ...string) error {
+	data, err := json.Marshal(invalidation{From: t.id, Keys: keys})
+	if err != nil {
+		return err
+	}
+	_, err = t.Remote.R.Publish(ctx, t.opts.Channel, data)
+	return err
+}
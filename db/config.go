@@ -0,0 +1,644 @@
+package db
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/BurntSushi/toml"
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// OptsError collects every problem found while loading or validating DBOpts.
+type OptsError struct {
+	Source string
+	Errs   []error
+}
+
+func (e *OptsError) Error() string {
+	msgs := make([]string, len(e.Errs))
+	for i, err := range e.Errs {
+		msgs[i] = err.Error()
+	}
+	return fmt.Sprintf("invalid database options from %s: %s", e.Source, strings.Join(msgs, "; "))
+}
+
+func (e *OptsError) add(format string, args ...interface{}) {
+	e.Errs = append(e.Errs, fmt.Errorf(format, args...))
+}
+
+func (e *OptsError) orNil() error {
+	if len(e.Errs) == 0 {
+		return nil
+	}
+	return e
+}
+
+// LoadOpts builds DBOpts from environment variables named after prefix, e.g.
+// for "PG":
+//
+//	PG_URL            connection URL, see ParseURL; fills the defaults
+//	PG_CONFIG_FILE    YAML, JSON or TOML file, see LoadOptsFile
+//	PG_HOST, PG_PORT, PG_USER, PG_DATABASE
+//	PG_PASSWORD       or PG_PASSWORD_FILE to read it from a mounted secret
+//	PG_TIMEOUT        Go duration or seconds
+//	PG_MAX_IDLE, PG_MAX_ACTIVE, PG_AUTHORIZATION
+//	PG_OPTIONS        driver options as key=value,key=value
+//	PG_RETRY_MAX_ATTEMPTS, PG_RETRY_INITIAL_BACKOFF, PG_RETRY_MAX_BACKOFF
+//	PG_TLS            true to enable TLS with the defaults, or any of
+//	PG_TLS_CA_FILE, PG_TLS_CERT_FILE, PG_TLS_KEY_FILE, PG_TLS_SERVER_NAME,
+//	PG_TLS_VERIFY     full, ca or skip
+//	PG_ADDRS          comma separated host:port seed addresses
+//	PG_MASTER_NAME, PG_CLUSTER  Redis Sentinel master name or Cluster mode
+//	PG_REPLICA_SET, PG_SRV, PG_AUTH_SOURCE, PG_AUTH_MECHANISM,
+//	PG_READ_PREFERENCE, PG_WRITE_CONCERN, PG_WRITE_TIMEOUT,
+//	PG_SKIP_LEGACY_SESSION  MongoDB settings
+//
+// Variables override values from PG_URL and PG_CONFIG_FILE. Every problem
+// found is reported in a single *OptsError.
+func LoadOpts(prefix string) (*DBOpts, error) {
+	prefix = strings.TrimSuffix(strings.ToUpper(prefix), "_")
+	env := func(name string) (string, bool) {
+		v, ok := os.LookupEnv(prefix + "_" + name)
+		return strings.TrimSpace(v), ok && strings.TrimSpace(v) != ""
+	}
+	name := func(name string) string { return prefix + "_" + name }
+	oe := &OptsError{Source: "environment " + prefix + "_*"}
+
+	opt := &DBOpts{}
+	if path, ok := env("CONFIG_FILE"); ok {
+		if fileOpt, err := readOptsFile(path); err != nil {
+			oe.add("%s: %v", name("CONFIG_FILE"), err)
+		} else {
+			opt = fileOpt
+		}
+	}
+	if raw, ok := env("URL"); ok {
+		_, urlOpt, err := ParseURL(raw)
+		if err != nil {
+			oe.add("%s: %v", name("URL"), err)
+		} else {
+			mergeOpts(opt, urlOpt)
+		}
+	}
+
+	if v, ok := env("HOST"); ok {
+		opt.Host = v
+	}
+	if v, ok := env("PORT"); ok {
+		if n, err := strconv.Atoi(v); err != nil {
+			oe.add("%s: %q is not a number", name("PORT"), v)
+		} else {
+			opt.Port = n
+		}
+	}
+	if v, ok := env("USER"); ok {
+		opt.User = v
+	}
+	if v, ok := env("DATABASE"); ok {
+		opt.Database = v
+	}
+	pw, hasPw := env("PASSWORD")
+	pwFile, hasPwFile := env("PASSWORD_FILE")
+	switch {
+	case hasPw && hasPwFile:
+		oe.add("only one of %s and %s may be set", name("PASSWORD"), name("PASSWORD_FILE"))
+	case hasPw:
+		opt.Password = pw
+	case hasPwFile:
+		if p, err := readSecretFile(pwFile); err != nil {
+			oe.add("%s: %v", name("PASSWORD_FILE"), err)
+		} else {
+			opt.Password = p
+		}
+	}
+	if v, ok := env("TIMEOUT"); ok {
+		if d, err := parseDuration(v); err != nil {
+			oe.add("%s: %q is not a duration", name("TIMEOUT"), v)
+		} else {
+			opt.Timeout = d
+		}
+	}
+	if v, ok := env("MAX_IDLE"); ok {
+		if n, err := strconv.Atoi(v); err != nil {
+			oe.add("%s: %q is not a number", name("MAX_IDLE"), v)
+		} else {
+			opt.MaxIdle = n
+		}
+	}
+	if v, ok := env("MAX_ACTIVE"); ok {
+		if n, err := strconv.Atoi(v); err != nil {
+			oe.add("%s: %q is not a number", name("MAX_ACTIVE"), v)
+		} else {
+			opt.MaxActive = n
+		}
+	}
+	if v, ok := env("AUTHORIZATION"); ok {
+		if b, err := strconv.ParseBool(v); err != nil {
+			oe.add("%s: %q is not a boolean", name("AUTHORIZATION"), v)
+		} else {
+			opt.Authorization = b
+		}
+	} else if opt.Password != "" {
+		opt.Authorization = true
+	}
+	if v, ok := env("OPTIONS"); ok {
+		for _, kv := range strings.Split(v, ",") {
+			parts := strings.SplitN(kv, "=", 2)
+			if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" {
+				oe.add("%s: %q is not key=value", name("OPTIONS"), kv)
+				continue
+			}
+			if opt.Options == nil {
+				opt.Options = make(map[string]string)
+			}
+			opt.Options[strings.TrimSpace(parts[0])] = strings.TrimSpace(parts[1])
+		}
+	}
+	if v, ok := env("ADDRS"); ok {
+		opt.Addrs = nil
+		for _, addr := range strings.Split(v, ",") {
+			if addr = strings.TrimSpace(addr); addr != "" {
+				opt.Addrs = append(opt.Addrs, addr)
+			}
+		}
+	}
+	if v, ok := env("MASTER_NAME"); ok {
+		opt.MasterName = v
+	}
+	if v, ok := env("CLUSTER"); ok {
+		if b, err := strconv.ParseBool(v); err != nil {
+			oe.add("%s: %q is not a boolean", name("CLUSTER"), v)
+		} else {
+			opt.Cluster = b
+		}
+	}
+	loadRetryEnv(opt, env, name, oe)
+	loadTLSEnv(opt, env, name, oe)
+	loadMongoEnv(opt, env, name, oe)
+
+	validateOpts(opt, name, oe)
+	if err := oe.orNil(); err != nil {
+		return nil, err
+	}
+	return opt, nil
+}
+
+func loadRetryEnv(opt *DBOpts, env func(string) (string, bool), name func(string) string, oe *OptsError) {
+	retry := opt.retryPolicy()
+	policy := *retry
+	set := false
+	if v, ok := env("RETRY_MAX_ATTEMPTS"); ok {
+		if n, err := strconv.Atoi(v); err != nil {
+			oe.add("%s: %q is not a number", name("RETRY_MAX_ATTEMPTS"), v)
+		} else {
+			policy.MaxAttempts, set = n, true
+		}
+	}
+	if v, ok := env("RETRY_INITIAL_BACKOFF"); ok {
+		if d, err := parseDuration(v); err != nil {
+			oe.add("%s: %q is not a duration", name("RETRY_INITIAL_BACKOFF"), v)
+		} else {
+			policy.InitialBackoff, set = d, true
+		}
+	}
+	if v, ok := env("RETRY_MAX_BACKOFF"); ok {
+		if d, err := parseDuration(v); err != nil {
+			oe.add("%s: %q is not a duration", name("RETRY_MAX_BACKOFF"), v)
+		} else {
+			policy.MaxBackoff, set = d, true
+		}
+	}
+	if set {
+		opt.Retry = &policy
+	}
+}
+
+func loadTLSEnv(opt *DBOpts, env func(string) (string, bool), name func(string) string, oe *OptsError) {
+	if v, ok := env("TLS"); ok {
+		enabled, err := strconv.ParseBool(v)
+		if err != nil {
+			oe.add("%s: %q is not a boolean", name("TLS"), v)
+		} else if !enabled {
+			opt.TLS = nil
+			return
+		} else if opt.TLS == nil {
+			opt.TLS = &TLSOpts{}
+		}
+	}
+	fields := []struct {
+		key string
+		dst func(t *TLSOpts) *string
+	}{
+		{"TLS_CA_FILE", func(t *TLSOpts) *string { return &t.CAFile }},
+		{"TLS_CERT_FILE", func(t *TLSOpts) *string { return &t.CertFile }},
+		{"TLS_KEY_FILE", func(t *TLSOpts) *string { return &t.KeyFile }},
+		{"TLS_SERVER_NAME", func(t *TLSOpts) *string { return &t.ServerName }},
+	}
+	for _, f := range fields {
+		if v, ok := env(f.key); ok {
+			if opt.TLS == nil {
+				opt.TLS = &TLSOpts{}
+			}
+			*f.dst(opt.TLS) = v
+		}
+	}
+	if v, ok := env("TLS_VERIFY"); ok {
+		if opt.TLS == nil {
+			opt.TLS = &TLSOpts{}
+		}
+		opt.TLS.Verify = TLSVerifyMode(v)
+	}
+}
+
+func loadMongoEnv(opt *DBOpts, env func(string) (string, bool), name func(string) string, oe *OptsError) {
+	mongo := func() *MongoOpts {
+		if opt.Mongo == nil {
+			opt.Mongo = &MongoOpts{}
+		}
+		return opt.Mongo
+	}
+	fields := []struct {
+		key string
+		dst func(m *MongoOpts) *string
+	}{
+		{"REPLICA_SET", func(m *MongoOpts) *string { return &m.ReplicaSet }},
+		{"AUTH_SOURCE", func(m *MongoOpts) *string { return &m.AuthSource }},
+		{"AUTH_MECHANISM", func(m *MongoOpts) *string { return &m.AuthMechanism }},
+		{"READ_PREFERENCE", func(m *MongoOpts) *string { return &m.ReadPreference }},
+		{"WRITE_CONCERN", func(m *MongoOpts) *string { return &m.WriteConcern }},
+	}
+	for _, f := range fields {
+		if v, ok := env(f.key); ok {
+			*f.dst(mongo()) = v
+		}
+	}
+	bools := []struct {
+		key string
+		dst func(m *MongoOpts) *bool
+	}{
+		{"SRV", func(m *MongoOpts) *bool { return &m.SRV }},
+		{"SKIP_LEGACY_SESSION", func(m *MongoOpts) *bool { return &m.SkipLegacySession }},
+	}
+	for _, f := range bools {
+		if v, ok := env(f.key); ok {
+			if b, err := strconv.ParseBool(v); err != nil {
+				oe.add("%s: %q is not a boolean", name(f.key), v)
+			} else {
+				*f.dst(mongo()) = b
+			}
+		}
+	}
+	if v, ok := env("WRITE_TIMEOUT"); ok {
+		if d, err := parseDuration(v); err != nil {
+			oe.add("%s: %q is not a duration", name("WRITE_TIMEOUT"), v)
+		} else {
+			mongo().WriteTimeout = d
+		}
+	}
+}
+
+// optsFile is the on-disk layout of DBOpts. Durations are strings so they can
+// be written as "5s" in every format.
+type optsFile struct {
+	URL           string            `json:"url" yaml:"url" toml:"url"`
+	Host          string            `json:"host" yaml:"host" toml:"host"`
+	Port          int               `json:"port" yaml:"port" toml:"port"`
+	User          string            `json:"user" yaml:"user" toml:"user"`
+	Password      string            `json:"password" yaml:"password" toml:"password"`
+	PasswordFile  string            `json:"password_file" yaml:"password_file" toml:"password_file"`
+	Database      string            `json:"database" yaml:"database" toml:"database"`
+	Timeout       string            `json:"timeout" yaml:"timeout" toml:"timeout"`
+	MaxIdle       int               `json:"max_idle" yaml:"max_idle" toml:"max_idle"`
+	MaxActive     int               `json:"max_active" yaml:"max_active" toml:"max_active"`
+	Authorization *bool             `json:"authorization" yaml:"authorization" toml:"authorization"`
+	Options       map[string]string `json:"options" yaml:"options" toml:"options"`
+	Retry         *retryFile        `json:"retry" yaml:"retry" toml:"retry"`
+	TLS           *tlsFile          `json:"tls" yaml:"tls" toml:"tls"`
+	Addrs         []string          `json:"addrs" yaml:"addrs" toml:"addrs"`
+	MasterName    string            `json:"master_name" yaml:"master_name" toml:"master_name"`
+	Cluster       bool              `json:"cluster" yaml:"cluster" toml:"cluster"`
+	Mongo         *mongoFile        `json:"mongo" yaml:"mongo" toml:"mongo"`
+}
+
+type retryFile struct {
+	MaxAttempts    int     `json:"max_attempts" yaml:"max_attempts" toml:"max_attempts"`
+	InitialBackoff string  `json:"initial_backoff" yaml:"initial_backoff" toml:"initial_backoff"`
+	MaxBackoff     string  `json:"max_backoff" yaml:"max_backoff" toml:"max_backoff"`
+	Multiplier     float64 `json:"multiplier" yaml:"multiplier" toml:"multiplier"`
+	Jitter         float64 `json:"jitter" yaml:"jitter" toml:"jitter"`
+}
+
+type tlsFile struct {
+	CAFile     string `json:"ca_file" yaml:"ca_file" toml:"ca_file"`
+	CertFile   string `json:"cert_file" yaml:"cert_file" toml:"cert_file"`
+	KeyFile    string `json:"key_file" yaml:"key_file" toml:"key_file"`
+	ServerName string `json:"server_name" yaml:"server_name" toml:"server_name"`
+	Verify     string `json:"verify" yaml:"verify" toml:"verify"`
+}
+
+type mongoFile struct {
+	ReplicaSet     string `json:"replica_set" yaml:"replica_set" toml:"replica_set"`
+	SRV            bool   `json:"srv" yaml:"srv" toml:"srv"`
+	AuthSource     string `json:"auth_source" yaml:"auth_source" toml:"auth_source"`
+	AuthMechanism  string `json:"auth_mechanism" yaml:"auth_mechanism" toml:"auth_mechanism"`
+	ReadPreference string `json:"read_preference" yaml:"read_preference" toml:"read_preference"`
+	WriteConcern   string `json:"write_concern" yaml:"write_concern" toml:"write_concern"`
+	WriteTimeout   string `json:"write_timeout" yaml:"write_timeout" toml:"write_timeout"`
+
+	SkipLegacySession bool `json:"skip_legacy_session" yaml:"skip_legacy_session" toml:"skip_legacy_session"`
+}
+
+// LoadOptsFile reads DBOpts from a YAML (.yaml, .yml), JSON (.json) or TOML
+// (.toml) file. Keys are snake_case versions of the DBOpts fields, plus url
+// and password_file as in LoadOpts.
+func LoadOptsFile(path string) (*DBOpts, error) {
+	opt, err := readOptsFile(path)
+	if err != nil {
+		return nil, err
+	}
+	oe := &OptsError{Source: path}
+	validateOpts(opt, strings.ToLower, oe)
+	if err := oe.orNil(); err != nil {
+		return nil, err
+	}
+	return opt, nil
+}
+
+// readOptsFile parses path without checking for required fields, so LoadOpts
+// can fill them from the environment first.
+func readOptsFile(path string) (*DBOpts, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "error reading database config file")
+	}
+
+	var f optsFile
+	switch ext := strings.ToLower(filepath.Ext(path)); ext {
+	case ".yaml", ".yml":
+		err = yaml.UnmarshalStrict(data, &f)
+	case ".json":
+		dec := json.NewDecoder(bytes.NewReader(data))
+		dec.DisallowUnknownFields()
+		err = dec.Decode(&f)
+	case ".toml":
+		var md toml.MetaData
+		if md, err = toml.Decode(string(data), &f); err == nil {
+			if undecoded := md.Undecoded(); len(undecoded) > 0 {
+				err = fmt.Errorf("unknown field %q", undecoded[0].String())
+			}
+		}
+	default:
+		return nil, fmt.Errorf("unsupported database config file type %q", ext)
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "error parsing database config file %s", path)
+	}
+
+	oe := &OptsError{Source: path}
+	opt := &DBOpts{}
+	if f.URL != "" {
+		_, urlOpt, err := ParseURL(f.URL)
+		if err != nil {
+			oe.add("url: %v", err)
+		} else {
+			opt = urlOpt
+		}
+	}
+	mergeOpts(opt, &DBOpts{
+		Host:       f.Host,
+		Port:       f.Port,
+		User:       f.User,
+		Password:   f.Password,
+		Database:   f.Database,
+		MaxIdle:    f.MaxIdle,
+		MaxActive:  f.MaxActive,
+		Options:    f.Options,
+		Addrs:      f.Addrs,
+		MasterName: f.MasterName,
+		Cluster:    f.Cluster,
+	})
+	if f.Password != "" && f.PasswordFile != "" {
+		oe.add("only one of password and password_file may be set")
+	} else if f.PasswordFile != "" {
+		if p, err := readSecretFile(f.PasswordFile); err != nil {
+			oe.add("password_file: %v", err)
+		} else {
+			opt.Password = p
+		}
+	}
+	if f.Timeout != "" {
+		if opt.Timeout, err = parseDuration(f.Timeout); err != nil {
+			oe.add("timeout: %q is not a duration", f.Timeout)
+		}
+	}
+	if f.Authorization != nil {
+		opt.Authorization = *f.Authorization
+	} else if opt.Password != "" {
+		opt.Authorization = true
+	}
+	if f.Retry != nil {
+		policy := DefaultRetryPolicy
+		if f.Retry.MaxAttempts != 0 {
+			policy.MaxAttempts = f.Retry.MaxAttempts
+		}
+		if f.Retry.InitialBackoff != "" {
+			if policy.InitialBackoff, err = parseDuration(f.Retry.InitialBackoff); err != nil {
+				oe.add("retry.initial_backoff: %q is not a duration", f.Retry.InitialBackoff)
+			}
+		}
+		if f.Retry.MaxBackoff != "" {
+			if policy.MaxBackoff, err = parseDuration(f.Retry.MaxBackoff); err != nil {
+				oe.add("retry.max_backoff: %q is not a duration", f.Retry.MaxBackoff)
+			}
+		}
+		if f.Retry.Multiplier != 0 {
+			policy.Multiplier = f.Retry.Multiplier
+		}
+		if f.Retry.Jitter != 0 {
+			policy.Jitter = f.Retry.Jitter
+		}
+		opt.Retry = &policy
+	}
+	if f.TLS != nil {
+		opt.TLS = &TLSOpts{
+			CAFile:     f.TLS.CAFile,
+			CertFile:   f.TLS.CertFile,
+			KeyFile:    f.TLS.KeyFile,
+			ServerName: f.TLS.ServerName,
+			Verify:     TLSVerifyMode(f.TLS.Verify),
+		}
+	}
+	if f.Mongo != nil {
+		mongo := &MongoOpts{
+			ReplicaSet:     f.Mongo.ReplicaSet,
+			SRV:            f.Mongo.SRV,
+			AuthSource:     f.Mongo.AuthSource,
+			AuthMechanism:  f.Mongo.AuthMechanism,
+			ReadPreference: f.Mongo.ReadPreference,
+			WriteConcern:   f.Mongo.WriteConcern,
+
+			SkipLegacySession: f.Mongo.SkipLegacySession,
+		}
+		if f.Mongo.WriteTimeout != "" {
+			if mongo.WriteTimeout, err = parseDuration(f.Mongo.WriteTimeout); err != nil {
+				oe.add("mongo.write_timeout: %q is not a duration", f.Mongo.WriteTimeout)
+			}
+		}
+		mergeOpts(opt, &DBOpts{Mongo: mongo})
+	}
+
+	if err := oe.orNil(); err != nil {
+		return nil, err
+	}
+	return opt, nil
+}
+
+// validateOpts checks the fields every driver needs. name maps a field name
+// like "HOST" to the key the user wrote.
+func validateOpts(opt *DBOpts, name func(string) string, oe *OptsError) {
+	srv := opt.Mongo != nil && opt.Mongo.SRV
+	if len(opt.Addrs) == 0 {
+		if opt.Host == "" {
+			oe.add("%s is required", name("HOST"))
+		}
+		if !srv && (opt.Port <= 0 || opt.Port > 65535) {
+			oe.add("%s must be between 1 and 65535, got %d", name("PORT"), opt.Port)
+		}
+	} else if srv {
+		oe.add("%s and %s can not be used together", name("ADDRS"), name("SRV"))
+	}
+	for _, addr := range opt.Addrs {
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			oe.add("%s: %q is not host:port", name("ADDRS"), addr)
+		}
+	}
+	if opt.MasterName != "" && opt.Cluster {
+		oe.add("%s and %s can not be used together", name("MASTER_NAME"), name("CLUSTER"))
+	}
+	if opt.Timeout < 0 {
+		oe.add("%s must not be negative", name("TIMEOUT"))
+	}
+	if opt.MaxIdle < 0 {
+		oe.add("%s must not be negative", name("MAX_IDLE"))
+	}
+	if opt.MaxActive < 0 {
+		oe.add("%s must not be negative", name("MAX_ACTIVE"))
+	}
+	if opt.Authorization && opt.User == "" && opt.Password == "" {
+		oe.add("%s is set but neither %s nor %s is", name("AUTHORIZATION"), name("USER"), name("PASSWORD"))
+	}
+	if opt.TLS != nil {
+		if err := opt.TLS.Validate(); err != nil {
+			oe.add("%s: %v", name("TLS"), err)
+		}
+	}
+	if opt.Mongo != nil {
+		if err := opt.Mongo.Validate(); err != nil {
+			oe.add("%s: %v", name("MONGO"), err)
+		}
+	}
+}
+
+// mergeOpts copies the non-zero fields of src over dst.
+func mergeOpts(dst, src *DBOpts) {
+	if src.Host != "" {
+		dst.Host = src.Host
+	}
+	if src.Port != 0 {
+		dst.Port = src.Port
+	}
+	if src.User != "" {
+		dst.User = src.User
+	}
+	if src.Password != "" {
+		dst.Password = src.Password
+	}
+	if src.Database != "" {
+		dst.Database = src.Database
+	}
+	if src.Timeout != 0 {
+		dst.Timeout = src.Timeout
+	}
+	if src.MaxIdle != 0 {
+		dst.MaxIdle = src.MaxIdle
+	}
+	if src.MaxActive != 0 {
+		dst.MaxActive = src.MaxActive
+	}
+	if src.Authorization {
+		dst.Authorization = true
+	}
+	if src.Retry != nil {
+		dst.Retry = src.Retry
+	}
+	if src.TLS != nil {
+		dst.TLS = src.TLS
+	}
+	if len(src.Addrs) > 0 {
+		dst.Addrs = src.Addrs
+	}
+	if src.MasterName != "" {
+		dst.MasterName = src.MasterName
+	}
+	if src.Cluster {
+		dst.Cluster = true
+	}
+	if src.Mongo != nil {
+		if dst.Mongo == nil {
+			dst.Mongo = &MongoOpts{}
+		}
+		mergeMongoOpts(dst.Mongo, src.Mongo)
+	}
+	for key, val := range src.Options {
+		if dst.Options == nil {
+			dst.Options = make(map[string]string)
+		}
+		dst.Options[key] = val
+	}
+}
+
+// mergeMongoOpts copies the MongoDB settings set in src over dst, keeping
+// the ones src leaves empty.
+func mergeMongoOpts(dst, src *MongoOpts) {
+	if src.ReplicaSet != "" {
+		dst.ReplicaSet = src.ReplicaSet
+	}
+	if src.SRV {
+		dst.SRV = true
+	}
+	if src.AuthSource != "" {
+		dst.AuthSource = src.AuthSource
+	}
+	if src.AuthMechanism != "" {
+		dst.AuthMechanism = src.AuthMechanism
+	}
+	if src.ReadPreference != "" {
+		dst.ReadPreference = src.ReadPreference
+	}
+	if src.WriteConcern != "" {
+		dst.WriteConcern = src.WriteConcern
+	}
+	if src.WriteTimeout != 0 {
+		dst.WriteTimeout = src.WriteTimeout
+	}
+	if src.SkipLegacySession {
+		dst.SkipLegacySession = true
+	}
+}
+
+// readSecretFile reads a password from a mounted secret, dropping the
+// trailing newline most tools write.
+func readSecretFile(path string) (string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(data), "\r\n"), nil
+}
@@ -1,15 +1,29 @@
 package db
 
 import (
-	"errors"
+	"context"
+	"fmt"
+	"sort"
+	"sync"
 	"time"
 )
 
 type DBManager interface {
 	Connect() error
+	// ConnectContext connects like Connect but gives up once ctx is done.
+	ConnectContext(ctx context.Context) error
 	Close()
+	// CloseContext stops accepting new work, waits for in-flight work to
+	// drain and closes the underlying connections. If ctx is done first the
+	// connections are still closed in the background and ctx.Err() is returned.
+	CloseContext(ctx context.Context) error
 	Option() *DBOpts
 	DBSource() string
+	// Ping checks that the database can be reached.
+	Ping(ctx context.Context) error
+	// Health pings the database and reports latency, pool stats and the
+	// class of any error.
+	Health(ctx context.Context) *Health
 }
 
 type DBOpts struct {
@@ -22,18 +36,105 @@ type DBOpts struct {
 	MaxIdle       int
 	MaxActive     int
 	Authorization bool
+	// Retry controls connection retries. Nil means DefaultRetryPolicy.
+	Retry *RetryPolicy
+	// Options holds driver specific connection parameters, added to the
+	// query string of DBSource.
+	Options map[string]string
+	// TLS enables encrypted connections. Nil means plaintext.
+	TLS *TLSOpts
+	// Addrs lists "host:port" seed addresses for drivers that talk to several
+	// servers. When empty, Host and Port are used.
+	Addrs []string
+	// MasterName makes the Redis driver treat Addrs as Sentinels and connect
+	// to the master they report under this name.
+	MasterName string
+	// Cluster makes the Redis driver treat Addrs as Redis Cluster seed nodes.
+	Cluster bool
+	// Mongo holds replica set, SRV, auth and read/write settings for the
+	// MongoDB driver.
+	Mongo *MongoOpts
+}
+
+// Factory returns a new, not yet connected, DBManager for the given options.
+// NewPool calls ConnectContext on the returned manager.
+type Factory func(opt *DBOpts) DBManager
+
+var (
+	driversMu sync.RWMutex
+	drivers   = make(map[string]Factory)
+)
+
+// Register makes a driver available by the provided name to NewPool.
+// If Register is called twice with the same name or if factory is nil,
+// it panics.
+func Register(name string, factory Factory) {
+	driversMu.Lock()
+	defer driversMu.Unlock()
+	if factory == nil {
+		panic("db: Register factory is nil")
+	}
+	if _, dup := drivers[name]; dup {
+		panic("db: Register called twice for driver " + name)
+	}
+	drivers[name] = factory
+}
+
+// Drivers returns a sorted list of the names of the registered drivers.
+func Drivers() []string {
+	driversMu.RLock()
+	defer driversMu.RUnlock()
+	list := make([]string, 0, len(drivers))
+	for name := range drivers {
+		list = append(list, name)
+	}
+	sort.Strings(list)
+	return list
 }
 
 func NewPool(driver string, opt *DBOpts) (DBManager, error) {
-	switch driver {
-	case "mongodb":
-		return NewMongoDB(opt)
-	case "redis":
-		return NewRedis(opt)
-	case "postgres":
-		return NewPostgres(opt)
-	case "mysql":
-		return NewMysql(opt)
+	return NewPoolContext(context.Background(), driver, opt)
+}
+
+// NewPoolContext is like NewPool but stops connecting once ctx is done.
+func NewPoolContext(ctx context.Context, driver string, opt *DBOpts) (DBManager, error) {
+	driversMu.RLock()
+	factory, ok := drivers[driver]
+	driversMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("can not find this driver type: %q", driver)
+	}
+
+	m := factory(opt)
+	if err := m.ConnectContext(ctx); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// sleepContext pauses for d or until ctx is done, whichever comes first.
+func sleepContext(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// closeContext runs closeFn in the background and waits for it to return
+// or for ctx to be done.
+func closeContext(ctx context.Context, closeFn func() error) error {
+	done := make(chan error, 1)
+	go func() {
+		done <- closeFn()
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
 	}
-	return nil, errors.New("can not find this driver type")
 }
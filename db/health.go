@@ -0,0 +1,235 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"github.com/go-sql-driver/mysql"
+	"github.com/lib/pq"
+	"github.com/pkg/errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrorClass groups health check failures into a few broad causes so probes
+// and dashboards don't have to parse driver specific messages.
+type ErrorClass string
+
+const (
+	ErrorClassNone        ErrorClass = ""
+	ErrorClassTimeout     ErrorClass = "timeout"
+	ErrorClassCanceled    ErrorClass = "canceled"
+	ErrorClassUnavailable ErrorClass = "unavailable"
+	ErrorClassAuth        ErrorClass = "auth"
+	ErrorClassUnknown     ErrorClass = "unknown"
+)
+
+type PoolStats struct {
+	Open  int `json:"open"`
+	InUse int `json:"inUse"`
+	Idle  int `json:"idle"`
+}
+
+type Health struct {
+	Healthy bool
+	Latency time.Duration
+	Stats   PoolStats
+	Err     error
+	Class   ErrorClass
+}
+
+func (h *Health) MarshalJSON() ([]byte, error) {
+	v := struct {
+		Healthy bool       `json:"healthy"`
+		Latency string     `json:"latency"`
+		Stats   PoolStats  `json:"stats"`
+		Error   string     `json:"error,omitempty"`
+		Class   ErrorClass `json:"class,omitempty"`
+	}{
+		Healthy: h.Healthy,
+		Latency: h.Latency.String(),
+		Stats:   h.Stats,
+		Class:   h.Class,
+	}
+	if h.Err != nil {
+		v.Error = h.Err.Error()
+	}
+	return json.Marshal(v)
+}
+
+func newHealth(start time.Time, err error, stats PoolStats) *Health {
+	return &Health{
+		Healthy: err == nil,
+		Latency: time.Since(start),
+		Stats:   stats,
+		Err:     err,
+		Class:   ClassifyError(err),
+	}
+}
+
+func sqlPoolStats(s sql.DBStats) PoolStats {
+	return PoolStats{Open: s.OpenConnections, InUse: s.InUse, Idle: s.Idle}
+}
+
+// ClassifyError reports the broad cause of a connection or ping error.
+func ClassifyError(err error) ErrorClass {
+	if err == nil {
+		return ErrorClassNone
+	}
+	if errors.Is(err, context.Canceled) {
+		return ErrorClassCanceled
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		return ErrorClassTimeout
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return ErrorClassTimeout
+	}
+
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) && pqErr.Code.Class() == "28" {
+		return ErrorClassAuth
+	}
+	var myErr *mysql.MySQLError
+	if errors.As(err, &myErr) && (myErr.Number == 1044 || myErr.Number == 1045) {
+		return ErrorClassAuth
+	}
+
+	msg := strings.ToLower(err.Error())
+	for _, s := range []string{"noauth", "wrongpass", "invalid password", "auth fail", "authentication failed", "access denied"} {
+		if strings.Contains(msg, s) {
+			return ErrorClassAuth
+		}
+	}
+
+	var opErr *net.OpError
+	if errors.As(err, &opErr) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) ||
+		strings.Contains(msg, "connection refused") || strings.Contains(msg, "no reachable servers") {
+		return ErrorClassUnavailable
+	}
+	return ErrorClassUnknown
+}
+
+// HealthChecker runs health checks against a set of named managers and
+// serves the results as readiness and liveness probes.
+type HealthChecker struct {
+	// Timeout bounds a single round of checks. Zero means no extra bound
+	// beyond the request context.
+	Timeout time.Duration
+
+	mu       sync.RWMutex
+	managers map[string]DBManager
+}
+
+func NewHealthChecker(timeout time.Duration) *HealthChecker {
+	return &HealthChecker{
+		Timeout:  timeout,
+		managers: make(map[string]DBManager),
+	}
+}
+
+// Add registers m under name, replacing any manager already using that name.
+func (h *HealthChecker) Add(name string, m DBManager) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.managers[name] = m
+}
+
+func (h *HealthChecker) Remove(name string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.managers, name)
+}
+
+// Check runs Health on every registered manager concurrently.
+func (h *HealthChecker) Check(ctx context.Context) map[string]*Health {
+	if h.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, h.Timeout)
+		defer cancel()
+	}
+
+	h.mu.RLock()
+	managers := make(map[string]DBManager, len(h.managers))
+	for name, m := range h.managers {
+		managers[name] = m
+	}
+	h.mu.RUnlock()
+
+	var (
+		wg  sync.WaitGroup
+		mu  sync.Mutex
+		res = make(map[string]*Health, len(managers))
+	)
+	for name, m := range managers {
+		wg.Add(1)
+		go func(name string, m DBManager) {
+			defer wg.Done()
+			hl := m.Health(ctx)
+			mu.Lock()
+			res[name] = hl
+			mu.Unlock()
+		}(name, m)
+	}
+	wg.Wait()
+	return res
+}
+
+// Healthy reports whether every registered manager is healthy.
+func (h *HealthChecker) Healthy(ctx context.Context) bool {
+	for _, hl := range h.Check(ctx) {
+		if !hl.Healthy {
+			return false
+		}
+	}
+	return true
+}
+
+// ServeHTTP serves the readiness probe.
+func (h *HealthChecker) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.ReadinessHandler().ServeHTTP(w, r)
+}
+
+// ReadinessHandler checks every manager and answers 200 when all of them are
+// healthy and 503 otherwise. The body lists the result per manager.
+func (h *HealthChecker) ReadinessHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		res := h.Check(r.Context())
+		status := http.StatusOK
+		for _, hl := range res {
+			if !hl.Healthy {
+				status = http.StatusServiceUnavailable
+			}
+		}
+
+		body := struct {
+			Status string             `json:"status"`
+			Checks map[string]*Health `json:"checks"`
+		}{Status: "ok", Checks: res}
+		if status != http.StatusOK {
+			body.Status = "unavailable"
+		}
+		writeJSON(w, status, body)
+	})
+}
+
+// LivenessHandler always answers 200 while the process can serve HTTP. It
+// deliberately does not ping the databases: restarting the process does not
+// fix an unreachable database, it only adds load when it comes back.
+func (h *HealthChecker) LivenessHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+	})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
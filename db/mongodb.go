@@ -1,40 +1,234 @@
 package db
 
 import (
-	"fmt"
+	"context"
+	"crypto/tls"
 	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/event"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
 	"gopkg.in/mgo.v2"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
+// MongoDB is backed by the official driver; use Client, or Database for the
+// configured database.
 type MongoDB struct {
-	DB  *mgo.Session
-	Opt *DBOpts
+	Client *mongo.Client
+	Opt    *DBOpts
+
+	// Deprecated: use Client. DB is the mgo session Connect still dials for
+	// code that has not moved over, unless MongoOpts.SkipLegacySession is set.
+	DB *mgo.Session
+
+	legacyMu sync.Mutex
+	open     atomic.Int64
+	inUse    atomic.Int64
+}
+
+func init() {
+	Register("mongodb", func(opt *DBOpts) DBManager {
+		return &MongoDB{Opt: opt}
+	})
 }
 
 func (m *MongoDB) Connect() error {
-	var err error
-	m.DB, err = mgo.Dial(m.DBSource())
+	return m.ConnectContext(context.Background())
+}
+
+// ConnectContext creates the client and pings the server, retrying as
+// configured by DBOpts.Retry, then dials the deprecated DB session. Timeout
+// bounds connecting and every socket read or write; MaxActive, or MaxIdle if
+// it is not set, caps the pool. On failure Client and DB are left nil.
+func (m *MongoDB) ConnectContext(ctx context.Context) error {
+	clientOpts, err := m.clientOptions()
+	if err != nil {
+		return err
+	}
+	client, err := mongo.Connect(ctx, clientOpts)
 	if err != nil {
 		return errors.Wrap(err, "MongoDB can not be connected")
 	}
-	m.DB.SetPoolLimit(m.Opt.MaxIdle)
-	m.DB.SetSocketTimeout(m.Opt.Timeout)
+	m.Client = client
+	if err := m.Opt.retryPolicy().retry(ctx, "MongoDB", m.Ping); err != nil {
+		client.Disconnect(context.Background())
+		m.Client = nil
+		return err
+	}
+	if m.Opt.Mongo == nil || !m.Opt.Mongo.SkipLegacySession {
+		if _, err := m.LegacySession(); err != nil {
+			client.Disconnect(context.Background())
+			m.Client = nil
+			return err
+		}
+	}
 	return nil
 }
 
+func (m *MongoDB) clientOptions() (*options.ClientOptions, error) {
+	if m.Opt.Mongo != nil {
+		if err := m.Opt.Mongo.Validate(); err != nil {
+			return nil, errors.Wrap(err, "MongoDB options are invalid")
+		}
+	}
+	o := options.Client().ApplyURI(m.DBSource()).
+		SetServerSelectionTimeout(10 * time.Second).
+		SetPoolMonitor(&event.PoolMonitor{Event: m.poolEvent})
+	if err := o.Validate(); err != nil {
+		return nil, errors.Wrap(err, "MongoDB options are invalid")
+	}
+	if m.Opt.Timeout > 0 {
+		o.SetConnectTimeout(m.Opt.Timeout).SetSocketTimeout(m.Opt.Timeout)
+	}
+	switch {
+	case m.Opt.MaxActive > 0:
+		o.SetMaxPoolSize(uint64(m.Opt.MaxActive))
+	case m.Opt.MaxIdle > 0:
+		o.SetMaxPoolSize(uint64(m.Opt.MaxIdle))
+	}
+	if m.Opt.TLS != nil {
+		cfg, err := m.Opt.TLS.Config(m.tlsHost())
+		if err != nil {
+			return nil, errors.Wrap(err, "MongoDB TLS config is invalid")
+		}
+		o.SetTLSConfig(cfg)
+	}
+	return o, nil
+}
+
+// tlsHost is the name certificates are checked against. With several
+// members, or members found through SRV, each is checked against its own.
+func (m *MongoDB) tlsHost() string {
+	if len(m.Opt.Addrs) > 0 || (m.Opt.Mongo != nil && m.Opt.Mongo.SRV) {
+		return ""
+	}
+	return m.Opt.Host
+}
+
+// poolEvent keeps the connection counts reported by Health.
+func (m *MongoDB) poolEvent(e *event.PoolEvent) {
+	switch e.Type {
+	case event.ConnectionCreated:
+		m.open.Add(1)
+	case event.ConnectionClosed:
+		m.open.Add(-1)
+	case event.GetSucceeded:
+		m.inUse.Add(1)
+	case event.ConnectionReturned:
+		m.inUse.Add(-1)
+	}
+}
+
+// Database returns the database named in DBOpts.
+func (m *MongoDB) Database() *mongo.Database {
+	return m.Client.Database(m.Opt.Database)
+}
+
+// LegacySession returns DB, dialing it first if Connect skipped it.
+//
+// Deprecated: use Client. mgo is unmaintained and does not support recent
+// servers; this only eases moving code over.
+func (m *MongoDB) LegacySession() (*mgo.Session, error) {
+	m.legacyMu.Lock()
+	defer m.legacyMu.Unlock()
+	if m.DB != nil {
+		return m.DB, nil
+	}
+
+	info, err := mgo.ParseURL(m.DBSource())
+	if err != nil {
+		return nil, errors.Wrap(err, "MongoDB can not be connected")
+	}
+	info.Timeout = 10 * time.Second
+	if m.Opt.TLS != nil {
+		cfg, err := m.Opt.TLS.Config(m.tlsHost())
+		if err != nil {
+			return nil, errors.Wrap(err, "MongoDB TLS config is invalid")
+		}
+		info.DialServer = func(addr *mgo.ServerAddr) (net.Conn, error) {
+			return tls.DialWithDialer(&net.Dialer{Timeout: info.Timeout}, "tcp", addr.String(), cfg)
+		}
+	}
+	s, err := mgo.DialWithInfo(info)
+	if err != nil {
+		return nil, errors.Wrap(err, "MongoDB can not be connected")
+	}
+	s.SetSyncTimeout(1 * time.Minute)
+	s.SetPoolLimit(m.Opt.MaxIdle)
+	s.SetSocketTimeout(m.Opt.Timeout)
+	m.DB = s
+	return s, nil
+}
+
 func (m *MongoDB) Close() {
-	m.DB.Close()
+	m.CloseContext(context.Background())
+}
+
+// CloseContext disconnects the client, waiting for operations in progress
+// until ctx is done, and closes the legacy session if there is one.
+func (m *MongoDB) CloseContext(ctx context.Context) error {
+	m.legacyMu.Lock()
+	if m.DB != nil {
+		m.DB.Close()
+		m.DB = nil
+	}
+	m.legacyMu.Unlock()
+	if m.Client == nil {
+		return nil
+	}
+	return m.Client.Disconnect(ctx)
+}
+
+func (m *MongoDB) Ping(ctx context.Context) error {
+	if m.Client == nil {
+		return errors.New("MongoDB is not connected")
+	}
+	return m.Client.Ping(ctx, nil)
+}
+
+func (m *MongoDB) Health(ctx context.Context) *Health {
+	start := time.Now()
+	err := m.Ping(ctx)
+	open, inUse := m.open.Load(), m.inUse.Load()
+	return newHealth(start, err, PoolStats{
+		Open:  int(open),
+		InUse: int(inUse),
+		Idle:  int(open - inUse),
+	})
 }
 
 func (m *MongoDB) Option() *DBOpts {
 	return m.Opt
 }
 
+// DBSource returns the connection string: mongodb+srv:// for SRV, otherwise
+// mongodb:// with every member of Addrs, or Host and Port.
 func (m *MongoDB) DBSource() string {
+	u := url.URL{
+		Scheme: "mongodb",
+		Host:   net.JoinHostPort(m.Opt.Host, strconv.Itoa(m.Opt.Port)),
+		Path:   "/" + m.Opt.Database,
+	}
+	if len(m.Opt.Addrs) > 0 {
+		u.Host = strings.Join(m.Opt.Addrs, ",")
+	}
+	var params map[string]string
+	if mo := m.Opt.Mongo; mo != nil {
+		params = mo.params()
+		if mo.SRV {
+			u.Scheme, u.Host = "mongodb+srv", m.Opt.Host
+		}
+	}
 	if m.Opt.Authorization {
-		return fmt.Sprintf("mongodb://%v:%v@%v:%v/%v", m.Opt.User, m.Opt.Password, m.Opt.Host, m.Opt.Port, m.Opt.Database)
+		u.User = url.UserPassword(m.Opt.User, m.Opt.Password)
 	}
-	return fmt.Sprintf("mongodb://%v:%v/%v", m.Opt.Host, m.Opt.Port, m.Opt.Database)
+	return u.String() + m.Opt.query(params)
 }
 
 func NewMongoDB(opt *DBOpts) (*MongoDB, error) {
@@ -45,105 +239,3 @@ func NewMongoDB(opt *DBOpts) (*MongoDB, error) {
 	}
 	return m, nil
 }
-
-//func (m *MongoDB) prepareMigration(ctx context.Context, conf *DBMigrationsConfig, assets []string, afn bindata.AssetFunc) (source.Driver, *migrate.Migrate, error) {
-//	var err error
-//	dsn := m.DBSource() + "?x-migrations-collection=" + conf.MigrationsItem
-//	driver := &mongodb.Mongo{}
-//	driver, err = driver.Open(dsn)
-//	if err != nil {
-//		return nil, nil, errors.Wrap(err, "error creating mongo driver")
-//	}
-//
-//	s, err := bindata.WithInstance(bindata.Resource(assets, afn))
-//	if err != nil {
-//		return nil, nil, errors.Wrap(err, "error creating source driver")
-//	}
-//
-//	mg, err := migrate.NewWithInstance("go-bindata", s, m.Opt.Database, driver)
-//	if err != nil {
-//		return nil, nil, errors.Wrap(err, "error creating a new Migrate instance")
-//	}
-//	mg.Log = conf.Logger
-//
-//	return s, mg, nil
-//}
-//
-//func (m *MongoDB) IsMigrationRequired(s source.Driver, mg *migrate.Migrate) (required bool, dirty bool, err error) {
-//	version, dirty, err := mg.Version()
-//	if err != nil {
-//		if err == migrate.ErrNilVersion {
-//			return true, false, nil
-//		}
-//		return false, false, errors.Wrap(err, "error getting current migration version")
-//	}
-//
-//	next, err := s.Next(version)
-//	if os.IsNotExist(err) {
-//		// no up migrations exist for the current database version
-//		return false, dirty, nil
-//	}
-//	if err != nil {
-//		return false, dirty, errors.Wrap(err, "error getting next migration")
-//	}
-//
-//	required = (next > version) || (next == version && dirty)
-//	return required, dirty, nil
-//}
-//
-//func (m *MongoDB) MigrateUpIfRequired(conf *DBMigrationsConfig, assets []string, afn bindata.AssetFunc) error {
-//	ctx, _ := context.WithTimeout(context.Background(), 1*time.Hour)
-//	s, mg, err := m.prepareMigration(ctx, conf, assets, afn)
-//	if err != nil {
-//		return errors.Wrap(err, "error preparing migration")
-//	}
-//
-//	required, dirty, err := m.IsMigrationRequired(s, mg)
-//	if err != nil {
-//		return errors.Wrap(err, "error checking if migration is required")
-//	}
-//
-//	if required && dirty {
-//		return errors.New("migration required, but the database is dirty")
-//	}
-//
-//	if !required {
-//		logrus.Infoln("database migration NOT required")
-//		return nil
-//	}
-//
-//	logrus.Infoln("database migrations required, migrating...")
-//	retry := 0
-//	for {
-//		err = mg.Up()
-//		if err == migrate.ErrNoChange {
-//			return nil
-//		}
-//
-//		if err == migrate.ErrLocked || err == migrate.ErrLockTimeout {
-//			retry++
-//			if retry > 5 {
-//				return errors.Wrap(err, "error migrating database")
-//			}
-//			logrus.WithField("retry", retry).Warnln("error obtaining lock")
-//
-//			time.Sleep(time.Duration(retry) * time.Second)
-//		}
-//	}
-//
-//	return nil
-//}
-//
-//func (m *MongoDB) MigrateUp(conf *DBMigrationsConfig, assets []string, afn bindata.AssetFunc) error {
-//	_, mg, err := m.prepareMigration(context.Background(), conf, assets, afn)
-//	if err != nil {
-//		return errors.Wrap(err, "error preparing migration")
-//	}
-//	defer m.Close()
-//
-//	if err := mg.Up(); err != nil && err != migrate.ErrNoChange {
-//		return errors.Wrap(err, "error migrating database")
-//	}
-//
-//	return nil
-//}
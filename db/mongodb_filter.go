@@ -0,0 +1,167 @@
+package db
+
+import (
+	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"strings"
+)
+
+// Filter builds a MongoDB query filter:
+//
+//	f := db.NewFilter().Eq("status", "active").Gte("age", 18).Lt("age", 65)
+//
+// Several operator conditions on one field are merged into one operator
+// document. Mixing Eq with another condition on the same field can not be
+// merged and is reported by Err. A nil *Filter matches every document;
+// adding a condition to it starts a new Filter.
+type Filter struct {
+	d   bson.D
+	err error
+}
+
+func NewFilter() *Filter {
+	return &Filter{d: bson.D{}}
+}
+
+// Doc returns the filter document.
+func (f *Filter) Doc() bson.D {
+	if f == nil {
+		return bson.D{}
+	}
+	return f.d
+}
+
+// Err returns the first condition that could not be added, if any.
+func (f *Filter) Err() error {
+	if f == nil {
+		return nil
+	}
+	return f.err
+}
+
+func (f *Filter) Eq(field string, val interface{}) *Filter {
+	if f == nil {
+		f = NewFilter()
+	}
+	if f.index(field) >= 0 {
+		return f.fail(field)
+	}
+	f.d = append(f.d, bson.E{Key: field, Value: val})
+	return f
+}
+
+func (f *Filter) Ne(field string, val interface{}) *Filter { return f.op(field, "$ne", val) }
+
+func (f *Filter) Gt(field string, val interface{}) *Filter { return f.op(field, "$gt", val) }
+
+func (f *Filter) Gte(field string, val interface{}) *Filter { return f.op(field, "$gte", val) }
+
+func (f *Filter) Lt(field string, val interface{}) *Filter { return f.op(field, "$lt", val) }
+
+func (f *Filter) Lte(field string, val interface{}) *Filter { return f.op(field, "$lte", val) }
+
+func (f *Filter) In(field string, vals ...interface{}) *Filter { return f.op(field, "$in", vals) }
+
+func (f *Filter) Nin(field string, vals ...interface{}) *Filter { return f.op(field, "$nin", vals) }
+
+func (f *Filter) Exists(field string, exists bool) *Filter { return f.op(field, "$exists", exists) }
+
+// Regex matches field against pattern with the given options, e.g. "i".
+func (f *Filter) Regex(field, pattern, options string) *Filter {
+	return f.op(field, "$regex", primitive.Regex{Pattern: pattern, Options: options})
+}
+
+// Or matches documents matching any of filters. Several calls must all
+// match, so they are combined with $and. Without filters it adds nothing.
+func (f *Filter) Or(filters ...*Filter) *Filter {
+	if f == nil {
+		f = NewFilter()
+	}
+	if len(filters) == 0 {
+		return f
+	}
+	docs := make(bson.A, len(filters))
+	for i, o := range filters {
+		if err := o.Err(); err != nil && f.err == nil {
+			f.err = err
+		}
+		docs[i] = o.Doc()
+	}
+	or := bson.E{Key: "$or", Value: docs}
+	if i := f.index("$and"); i >= 0 {
+		f.d[i].Value = append(f.d[i].Value.(bson.A), bson.D{or})
+		return f
+	}
+	if i := f.index("$or"); i >= 0 {
+		prev := f.d[i]
+		f.d = append(f.d[:i], f.d[i+1:]...)
+		f.d = append(f.d, bson.E{Key: "$and", Value: bson.A{bson.D{prev}, bson.D{or}}})
+		return f
+	}
+	f.d = append(f.d, or)
+	return f
+}
+
+func (f *Filter) op(field, op string, val interface{}) *Filter {
+	if f == nil {
+		f = NewFilter()
+	}
+	i := f.index(field)
+	if i < 0 {
+		f.d = append(f.d, bson.E{Key: field, Value: bson.D{{Key: op, Value: val}}})
+		return f
+	}
+	ops, ok := f.d[i].Value.(bson.D)
+	if !ok || !isOperatorDoc(ops) {
+		return f.fail(field)
+	}
+	f.d[i].Value = append(ops, bson.E{Key: op, Value: val})
+	return f
+}
+
+func (f *Filter) index(field string) int {
+	for i, e := range f.d {
+		if e.Key == field {
+			return i
+		}
+	}
+	return -1
+}
+
+func (f *Filter) fail(field string) *Filter {
+	if f.err == nil {
+		f.err = errors.Errorf("filter on %s mixes an equality with another condition", field)
+	}
+	return f
+}
+
+// isOperatorDoc reports whether d holds query operators such as $gt, rather
+// than a document to compare with.
+func isOperatorDoc(d bson.D) bool {
+	if len(d) == 0 {
+		return false
+	}
+	for _, e := range d {
+		if !strings.HasPrefix(e.Key, "$") {
+			return false
+		}
+	}
+	return true
+}
+
+// SortBy builds a sort document from field names, descending when prefixed
+// with "-":
+//
+//	db.SortBy("-created", "name")
+func SortBy(fields ...string) bson.D {
+	d := make(bson.D, 0, len(fields))
+	for _, field := range fields {
+		if strings.HasPrefix(field, "-") {
+			d = append(d, bson.E{Key: field[1:], Value: -1})
+		} else {
+			d = append(d, bson.E{Key: strings.TrimPrefix(field, "+"), Value: 1})
+		}
+	}
+	return d
+}
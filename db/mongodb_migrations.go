@@ -0,0 +1,243 @@
+package db
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/golang-migrate/migrate"
+	"github.com/golang-migrate/migrate/database"
+	"github.com/golang-migrate/migrate/source"
+	"github.com/golang-migrate/migrate/source/go_bindata"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+)
+
+// mongoLockTimeout is how old a migration lock has to be before another
+// process may break it, in case its holder died.
+const mongoLockTimeout = 15 * time.Minute
+
+// mongoMigrationDriver is a golang-migrate database driver for MongoDB. The
+// version and the lock are documents in the migrations collection.
+//
+// A migration file holds one database command as extended JSON, or an array
+// of them run in order:
+//
+//	[
+//		{"create": "users"},
+//		{"createIndexes": "users", "indexes": [{"key": {"email": 1}, "name": "email", "unique": true}]}
+//	]
+type mongoMigrationDriver struct {
+	db         *mongo.Database
+	collection string
+}
+
+func (d *mongoMigrationDriver) Open(url string) (database.Driver, error) {
+	return nil, errors.New("MongoDB migration driver can only be used with an existing connection")
+}
+
+func (d *mongoMigrationDriver) Close() error {
+	// the client belongs to MongoDB
+	return nil
+}
+
+func (d *mongoMigrationDriver) coll() *mongo.Collection {
+	return d.db.Collection(d.collection)
+}
+
+func (d *mongoMigrationDriver) Lock() error {
+	ctx := context.Background()
+	lock := bson.M{"_id": "lock", "locked_at": time.Now()}
+	_, err := d.coll().InsertOne(ctx, lock)
+	if mongo.IsDuplicateKeyError(err) {
+		// break the lock of a process that died while migrating
+		stale := bson.M{"_id": "lock", "locked_at": bson.M{"$lt": time.Now().Add(-mongoLockTimeout)}}
+		res, derr := d.coll().DeleteOne(ctx, stale)
+		if derr != nil || res.DeletedCount == 0 {
+			return database.ErrLocked
+		}
+		_, err = d.coll().InsertOne(ctx, lock)
+		if mongo.IsDuplicateKeyError(err) {
+			return database.ErrLocked
+		}
+	}
+	return err
+}
+
+func (d *mongoMigrationDriver) Unlock() error {
+	_, err := d.coll().DeleteOne(context.Background(), bson.M{"_id": "lock"})
+	return err
+}
+
+func (d *mongoMigrationDriver) Run(migration io.Reader) error {
+	data, err := ioutil.ReadAll(migration)
+	if err != nil {
+		return err
+	}
+	cmds, err := parseMongoCommands(data)
+	if err != nil {
+		return err
+	}
+	for i, cmd := range cmds {
+		if err := d.db.RunCommand(context.Background(), cmd).Err(); err != nil {
+			return errors.Wrapf(err, "migration command %d failed", i+1)
+		}
+	}
+	return nil
+}
+
+// parseMongoCommands reads one command or an array of commands, keeping the
+// key order since the command name must come first.
+func parseMongoCommands(data []byte) ([]bson.D, error) {
+	trimmed := strings.TrimSpace(string(data))
+	if trimmed == "" {
+		return nil, nil
+	}
+	raws := []json.RawMessage{json.RawMessage(trimmed)}
+	if strings.HasPrefix(trimmed, "[") {
+		if err := json.Unmarshal(data, &raws); err != nil {
+			return nil, errors.Wrap(err, "migration is not valid JSON")
+		}
+	}
+	cmds := make([]bson.D, 0, len(raws))
+	for i, raw := range raws {
+		var cmd bson.D
+		if err := bson.UnmarshalExtJSON(raw, false, &cmd); err != nil {
+			return nil, errors.Wrapf(err, "migration command %d is not valid extended JSON", i+1)
+		}
+		cmds = append(cmds, cmd)
+	}
+	return cmds, nil
+}
+
+func (d *mongoMigrationDriver) SetVersion(version int, dirty bool) error {
+	_, err := d.coll().ReplaceOne(context.Background(), bson.M{"_id": "version"},
+		bson.M{"_id": "version", "version": version, "dirty": dirty},
+		options.Replace().SetUpsert(true))
+	return err
+}
+
+func (d *mongoMigrationDriver) Version() (int, bool, error) {
+	var doc struct {
+		Version int  `bson:"version"`
+		Dirty   bool `bson:"dirty"`
+	}
+	err := d.coll().FindOne(context.Background(), bson.M{"_id": "version"}).Decode(&doc)
+	if err == mongo.ErrNoDocuments {
+		return database.NilVersion, false, nil
+	}
+	if err != nil {
+		return 0, false, err
+	}
+	return doc.Version, doc.Dirty, nil
+}
+
+func (d *mongoMigrationDriver) Drop() error {
+	return d.db.Drop(context.Background())
+}
+
+func (m *MongoDB) IsMigrationRequired(s source.Driver, mg *migrate.Migrate) (required bool, dirty bool, err error) {
+	version, dirty, err := mg.Version()
+	if err != nil {
+		if err == migrate.ErrNilVersion {
+			return true, false, nil
+		}
+		return false, false, errors.Wrap(err, "error getting current migration version")
+	}
+
+	next, err := s.Next(version)
+	if os.IsNotExist(err) {
+		// no up migrations exist for the current database version
+		return false, dirty, nil
+	}
+	if err != nil {
+		return false, dirty, errors.Wrap(err, "error getting next migration")
+	}
+
+	required = (next > version) || (next == version && dirty)
+	return required, dirty, nil
+}
+
+func (m *MongoDB) prepareMigration(conf *DBMigrationsConfig, assets []string, afn bindata.AssetFunc) (source.Driver, *migrate.Migrate, error) {
+	name := conf.DatabaseName
+	if name == "" {
+		name = m.Opt.Database
+	}
+	driver := &mongoMigrationDriver{db: m.Client.Database(name), collection: conf.MigrationsItem}
+
+	s, err := bindata.WithInstance(bindata.Resource(assets, afn))
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "error creating source driver")
+	}
+
+	mg, err := migrate.NewWithInstance("go-bindata", s, name, driver)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "error creating a new Migrate instance")
+	}
+	mg.Log = conf.Logger
+
+	return s, mg, nil
+}
+
+func (m *MongoDB) MigrateUpIfRequired(conf *DBMigrationsConfig, assets []string, afn bindata.AssetFunc) error {
+	s, mg, err := m.prepareMigration(conf, assets, afn)
+	if err != nil {
+		return errors.Wrap(err, "error preparing migration")
+	}
+	defer mg.Close()
+
+	required, dirty, err := m.IsMigrationRequired(s, mg)
+	if err != nil {
+		return errors.Wrap(err, "error checking if migration is required")
+	}
+
+	if required && dirty {
+		return errors.New("migration required, but the database is dirty")
+	}
+
+	if !required {
+		logrus.Infoln("database migration NOT required")
+		return nil
+	}
+
+	logrus.Infoln("database migrations required, migrating...")
+	retry := 0
+	for {
+		err = mg.Up()
+		if err == nil || err == migrate.ErrNoChange {
+			return nil
+		}
+
+		// the driver's own lock error is passed through by migrate as is
+		if err != migrate.ErrLocked && err != migrate.ErrLockTimeout && err != database.ErrLocked {
+			return errors.Wrap(err, "error migrating database")
+		}
+		retry++
+		if retry > 5 {
+			return errors.Wrap(err, "error migrating database")
+		}
+		logrus.WithField("retry", retry).Warnln("error obtaining lock")
+
+		time.Sleep(time.Duration(retry) * time.Second)
+	}
+}
+
+func (m *MongoDB) MigrateUp(conf *DBMigrationsConfig, assets []string, afn bindata.AssetFunc) error {
+	_, mg, err := m.prepareMigration(conf, assets, afn)
+	if err != nil {
+		return errors.Wrap(err, "error preparing migration")
+	}
+	defer mg.Close()
+
+	if err := mg.Up(); err != nil && err != migrate.ErrNoChange {
+		return errors.Wrap(err, "error migrating database")
+	}
+
+	return nil
+}
@@ -0,0 +1,102 @@
+package db
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// MongoOpts holds MongoDB deployment settings. The members of a replica set
+// go in DBOpts.Addrs.
+type MongoOpts struct {
+	ReplicaSet string
+	// SRV looks up the members through the DNS SRV records of Host, as with
+	// a mongodb+srv:// URL. Port and Addrs are not used.
+	SRV bool
+	// AuthSource is the database holding the user, Database by default.
+	AuthSource string
+	// AuthMechanism is e.g. SCRAM-SHA-256 or MONGODB-X509; the server
+	// chooses when empty.
+	AuthMechanism string
+	// ReadPreference is primary (the default), primaryPreferred, secondary,
+	// secondaryPreferred or nearest.
+	ReadPreference string
+	// WriteConcern is "majority", a number of members or a tag set name.
+	WriteConcern string
+	// WriteTimeout bounds how long a write waits for its write concern.
+	WriteTimeout time.Duration
+	// SkipLegacySession keeps Connect from dialing the deprecated mgo
+	// session in MongoDB.DB, e.g. for servers mgo can not talk to.
+	SkipLegacySession bool
+}
+
+var (
+	mongoReadPreferences = map[string]bool{
+		"primary": true, "primaryPreferred": true, "secondary": true, "secondaryPreferred": true, "nearest": true,
+	}
+	mongoAuthMechanisms = map[string]bool{
+		"SCRAM-SHA-1": true, "SCRAM-SHA-256": true, "MONGODB-X509": true, "MONGODB-AWS": true, "GSSAPI": true, "PLAIN": true,
+	}
+)
+
+// Validate reports settings the driver would reject.
+func (o *MongoOpts) Validate() error {
+	if o.ReadPreference != "" && !mongoReadPreferences[o.ReadPreference] {
+		return fmt.Errorf("unknown read preference %q", o.ReadPreference)
+	}
+	if o.AuthMechanism != "" && !mongoAuthMechanisms[o.AuthMechanism] {
+		return fmt.Errorf("unknown auth mechanism %q", o.AuthMechanism)
+	}
+	if o.WriteTimeout < 0 {
+		return fmt.Errorf("write timeout must not be negative")
+	}
+	return nil
+}
+
+// mongoURLParams are the connection string options kept in MongoOpts
+// rather than DBOpts.Options.
+var mongoURLParams = map[string]bool{
+	"replicaSet": true, "authSource": true, "authMechanism": true, "readPreference": true, "w": true, "wtimeoutMS": true,
+}
+
+// set fills the field of a connection string option.
+func (o *MongoOpts) set(key, val string) error {
+	switch key {
+	case "replicaSet":
+		o.ReplicaSet = val
+	case "authSource":
+		o.AuthSource = val
+	case "authMechanism":
+		o.AuthMechanism = val
+	case "readPreference":
+		o.ReadPreference = val
+	case "w":
+		o.WriteConcern = val
+	case "wtimeoutMS":
+		ms, err := strconv.Atoi(val)
+		if err != nil {
+			return fmt.Errorf("invalid wtimeoutMS %q in database url", val)
+		}
+		o.WriteTimeout = time.Duration(ms) * time.Millisecond
+	}
+	return nil
+}
+
+// params returns the settings as connection string options.
+func (o *MongoOpts) params() map[string]string {
+	p := make(map[string]string)
+	set := func(key, val string) {
+		if val != "" {
+			p[key] = val
+		}
+	}
+	set("replicaSet", o.ReplicaSet)
+	set("authSource", o.AuthSource)
+	set("authMechanism", o.AuthMechanism)
+	set("readPreference", o.ReadPreference)
+	set("w", o.WriteConcern)
+	if o.WriteTimeout > 0 {
+		p["wtimeoutMS"] = strconv.FormatInt(Millis(o.WriteTimeout), 10)
+	}
+	return p
+}
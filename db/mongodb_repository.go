@@ -0,0 +1,184 @@
+package db
+
+import (
+	"context"
+	"github.com/akikistyle/caplibgo/pager"
+	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// ErrNotFound is returned by Repository when no document matches.
+var ErrNotFound = errors.New("document not found")
+
+// Repository reads and writes documents of type T in one collection. T is
+// mapped with the usual bson struct tags; its _id field is the ID used by
+// FindByID, UpdateFields and Delete.
+type Repository[T any] struct {
+	Collection *mongo.Collection
+}
+
+// NewRepository returns a repository for collection in the database of m.
+func NewRepository[T any](m *MongoDB, collection string) *Repository[T] {
+	return &Repository[T]{Collection: m.Database().Collection(collection)}
+}
+
+func byID(id interface{}) bson.D {
+	return bson.D{{Key: "_id", Value: id}}
+}
+
+func (r *Repository[T]) FindByID(ctx context.Context, id interface{}) (*T, error) {
+	return r.FindOne(ctx, &Filter{d: byID(id)})
+}
+
+// FindOne returns the first document matching f, or ErrNotFound.
+func (r *Repository[T]) FindOne(ctx context.Context, f *Filter, opts ...*options.FindOneOptions) (*T, error) {
+	if err := f.Err(); err != nil {
+		return nil, err
+	}
+	doc := new(T)
+	err := r.Collection.FindOne(ctx, f.Doc(), opts...).Decode(doc)
+	if err == mongo.ErrNoDocuments {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "error finding document in %s", r.Collection.Name())
+	}
+	return doc, nil
+}
+
+// Find returns every document matching f. Use options.Find() for sorting,
+// projection or limits.
+func (r *Repository[T]) Find(ctx context.Context, f *Filter, opts ...*options.FindOptions) ([]T, error) {
+	if err := f.Err(); err != nil {
+		return nil, err
+	}
+	cur, err := r.Collection.Find(ctx, f.Doc(), opts...)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error finding documents in %s", r.Collection.Name())
+	}
+	docs := []T{}
+	if err := cur.All(ctx, &docs); err != nil {
+		return nil, errors.Wrapf(err, "error decoding documents from %s", r.Collection.Name())
+	}
+	return docs, nil
+}
+
+// FindPage returns one page of the documents matching f along with the
+// pager for the response. page starts at 1; a pageSize below 1 returns
+// every document. sort takes field names as SortBy does.
+func (r *Repository[T]) FindPage(ctx context.Context, f *Filter, pageSize, page int, sort ...string) ([]T, *pager.Pager, error) {
+	count, err := r.Count(ctx, f)
+	if err != nil {
+		return nil, nil, err
+	}
+	p := &pager.Pager{}
+	p.GetPager(pageSize, page, int(count))
+
+	opts := options.Find()
+	if len(sort) > 0 {
+		opts.SetSort(SortBy(sort...))
+	}
+	if pageSize > 0 {
+		opts.SetSkip(int64(p.Start)).SetLimit(int64(pageSize))
+	}
+	docs, err := r.Find(ctx, f, opts)
+	if err != nil {
+		return nil, nil, err
+	}
+	return docs, p, nil
+}
+
+func (r *Repository[T]) Count(ctx context.Context, f *Filter) (int64, error) {
+	if err := f.Err(); err != nil {
+		return 0, err
+	}
+	n, err := r.Collection.CountDocuments(ctx, f.Doc())
+	if err != nil {
+		return 0, errors.Wrapf(err, "error counting documents in %s", r.Collection.Name())
+	}
+	return n, nil
+}
+
+// Insert adds doc and returns its _id, generated by the driver if doc has
+// none.
+func (r *Repository[T]) Insert(ctx context.Context, doc *T) (interface{}, error) {
+	res, err := r.Collection.InsertOne(ctx, doc)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error inserting document into %s", r.Collection.Name())
+	}
+	return res.InsertedID, nil
+}
+
+// Upsert replaces the document matching f with doc, inserting it if there
+// is none.
+func (r *Repository[T]) Upsert(ctx context.Context, f *Filter, doc *T) error {
+	if err := f.Err(); err != nil {
+		return err
+	}
+	_, err := r.Collection.ReplaceOne(ctx, f.Doc(), doc, options.Replace().SetUpsert(true))
+	if err != nil {
+		return errors.Wrapf(err, "error upserting document into %s", r.Collection.Name())
+	}
+	return nil
+}
+
+// UpdateFields sets the given fields of the document with the id, or
+// returns ErrNotFound.
+func (r *Repository[T]) UpdateFields(ctx context.Context, id interface{}, fields bson.M) error {
+	res, err := r.Collection.UpdateOne(ctx, byID(id), bson.D{{Key: "$set", Value: fields}})
+	if err != nil {
+		return errors.Wrapf(err, "error updating document in %s", r.Collection.Name())
+	}
+	if res.MatchedCount == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// Delete removes the document with the id, or returns ErrNotFound.
+func (r *Repository[T]) Delete(ctx context.Context, id interface{}) error {
+	res, err := r.Collection.DeleteOne(ctx, byID(id))
+	if err != nil {
+		return errors.Wrapf(err, "error deleting document from %s", r.Collection.Name())
+	}
+	if res.DeletedCount == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// DeleteMany removes every document matching f and returns how many.
+func (r *Repository[T]) DeleteMany(ctx context.Context, f *Filter) (int64, error) {
+	if err := f.Err(); err != nil {
+		return 0, err
+	}
+	res, err := r.Collection.DeleteMany(ctx, f.Doc())
+	if err != nil {
+		return 0, errors.Wrapf(err, "error deleting documents from %s", r.Collection.Name())
+	}
+	return res.DeletedCount, nil
+}
+
+// Index describes an index on fields, given as SortBy does.
+func Index(unique bool, fields ...string) mongo.IndexModel {
+	return mongo.IndexModel{Keys: SortBy(fields...), Options: options.Index().SetUnique(unique)}
+}
+
+// EnsureIndexes creates the indexes that do not exist yet and returns their
+// names.
+func (r *Repository[T]) EnsureIndexes(ctx context.Context, indexes ...mongo.IndexModel) ([]string, error) {
+	names, err := r.Collection.Indexes().CreateMany(ctx, indexes)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error creating indexes on %s", r.Collection.Name())
+	}
+	return names, nil
+}
+
+func (r *Repository[T]) DropIndex(ctx context.Context, name string) error {
+	if _, err := r.Collection.Indexes().DropOne(ctx, name); err != nil {
+		return errors.Wrapf(err, "error dropping index %s on %s", name, r.Collection.Name())
+	}
+	return nil
+}
@@ -0,0 +1,121 @@
+package db
+
+import (
+	"context"
+	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/mongo/readconcern"
+	"go.mongodb.org/mongo-driver/mongo/writeconcern"
+	"strconv"
+	"time"
+)
+
+// DefaultMongoTxTimeout bounds all attempts of a transaction unless
+// MongoTxTimeout is given.
+const DefaultMongoTxTimeout = 2 * time.Minute
+
+type mongoTx struct {
+	opts    *options.TransactionOptions
+	timeout time.Duration
+}
+
+type MongoTxOption func(*mongoTx)
+
+// MongoTxReadConcern sets the read concern level: local, majority or
+// snapshot.
+func MongoTxReadConcern(level string) MongoTxOption {
+	return func(tx *mongoTx) {
+		tx.opts.SetReadConcern(&readconcern.ReadConcern{Level: level})
+	}
+}
+
+// MongoTxWriteConcern sets the write concern of the commit: "majority", a
+// number of members or a tag set name, waiting at most timeout if it is
+// positive.
+func MongoTxWriteConcern(w string, timeout time.Duration) MongoTxOption {
+	return func(tx *mongoTx) {
+		wc := &writeconcern.WriteConcern{W: w, WTimeout: timeout}
+		if n, err := strconv.Atoi(w); err == nil {
+			wc.W = n
+		}
+		tx.opts.SetWriteConcern(wc)
+	}
+}
+
+// MongoTxTimeout bounds how long the transaction may take, every attempt
+// and retry included. Zero leaves it to the deadline of ctx.
+func MongoTxTimeout(d time.Duration) MongoTxOption {
+	return func(tx *mongoTx) {
+		tx.timeout = d
+	}
+}
+
+// WithTransaction runs fn in a multi-document transaction and commits it.
+// fn must pass sc to every operation that belongs to the transaction. If fn
+// or the commit fails with a TransientTransactionError, fn runs again; a
+// commit failing with UnknownTransactionCommitResult is retried on its own.
+// Retries back off and stop once the timeout has passed; sc carries that
+// deadline, so fn and the commit are cut off too. Other errors from fn abort
+// the transaction and are returned as they are.
+//
+// Transactions need a replica set or sharded cluster.
+func (m *MongoDB) WithTransaction(ctx context.Context, fn func(sc mongo.SessionContext) error, opts ...MongoTxOption) error {
+	tx := &mongoTx{opts: options.Transaction(), timeout: DefaultMongoTxTimeout}
+	for _, o := range opts {
+		o(tx)
+	}
+	if tx.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, tx.timeout)
+		defer cancel()
+	}
+
+	sess, err := m.Client.StartSession()
+	if err != nil {
+		return errors.Wrap(err, "error starting MongoDB session")
+	}
+	defer sess.EndSession(context.Background())
+
+	for attempt := 1; ; attempt++ {
+		if err := sess.StartTransaction(tx.opts); err != nil {
+			return errors.Wrap(err, "error starting MongoDB transaction")
+		}
+		err := fn(mongo.NewSessionContext(ctx, sess))
+		if err == nil {
+			err = commitMongoTx(ctx, sess)
+			if err == nil {
+				return nil
+			}
+		} else {
+			sess.AbortTransaction(context.Background())
+		}
+		if !hasErrorLabel(err, "TransientTransactionError") || ctx.Err() != nil {
+			return err
+		}
+		if serr := sleepContext(ctx, txRetryPolicy.Backoff(attempt)); serr != nil {
+			return err
+		}
+	}
+}
+
+func commitMongoTx(ctx context.Context, sess mongo.Session) error {
+	for attempt := 1; ; attempt++ {
+		err := sess.CommitTransaction(ctx)
+		if err == nil || !hasErrorLabel(err, "UnknownTransactionCommitResult") || ctx.Err() != nil {
+			return err
+		}
+		if se, ok := err.(mongo.ServerError); ok && se.HasErrorCode(50) {
+			// MaxTimeMSExpired: the commit itself ran out of time
+			return err
+		}
+		if sleepContext(ctx, txRetryPolicy.Backoff(attempt)) != nil {
+			return err
+		}
+	}
+}
+
+func hasErrorLabel(err error, label string) bool {
+	var le mongo.LabeledError
+	return errors.As(err, &le) && le.HasErrorLabel(label)
+}
@@ -0,0 +1,304 @@
+package db
+
+import (
+	"context"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"sync"
+	"time"
+)
+
+// ChangeEvent is a change stream event. FullDocument is empty for deletes,
+// and for updates unless WatchOptions.FullDocument is set.
+type ChangeEvent struct {
+	Token         bson.Raw `bson:"_id"`
+	OperationType string   `bson:"operationType"`
+	Namespace     struct {
+		DB         string `bson:"db"`
+		Collection string `bson:"coll"`
+	} `bson:"ns"`
+	DocumentKey       bson.Raw            `bson:"documentKey"`
+	FullDocument      bson.Raw            `bson:"fullDocument"`
+	UpdateDescription *UpdateDescription  `bson:"updateDescription"`
+	ClusterTime       primitive.Timestamp `bson:"clusterTime"`
+}
+
+type UpdateDescription struct {
+	UpdatedFields bson.Raw `bson:"updatedFields"`
+	RemovedFields []string `bson:"removedFields"`
+}
+
+// DocumentID returns the _id of the changed document.
+func (e *ChangeEvent) DocumentID() bson.RawValue {
+	if len(e.DocumentKey) == 0 {
+		return bson.RawValue{}
+	}
+	return e.DocumentKey.Lookup("_id")
+}
+
+// Decode unmarshals the full document into v.
+func (e *ChangeEvent) Decode(v interface{}) error {
+	if len(e.FullDocument) == 0 {
+		return errors.Errorf("%s event on %s has no full document", e.OperationType, e.Namespace.Collection)
+	}
+	return bson.Unmarshal(e.FullDocument, v)
+}
+
+// TokenStore persists change stream resume tokens under a name. Load
+// returns nil if nothing was saved yet.
+type TokenStore interface {
+	Load(ctx context.Context, name string) (bson.Raw, error)
+	Save(ctx context.Context, name string, token bson.Raw) error
+}
+
+// RedisTokenStore keeps resume tokens in Redis under Prefix+name.
+type RedisTokenStore struct {
+	R      *Redis
+	Prefix string
+}
+
+func NewRedisTokenStore(r *Redis, prefix string) *RedisTokenStore {
+	return &RedisTokenStore{R: r, Prefix: prefix}
+}
+
+func (s *RedisTokenStore) Load(ctx context.Context, name string) (bson.Raw, error) {
+	v, err := s.R.Do(ctx, "GET", s.Prefix+name)
+	if err != nil || v == nil {
+		return nil, err
+	}
+	b, ok := v.([]byte)
+	if !ok {
+		return nil, errors.Errorf("unexpected resume token type %T", v)
+	}
+	return bson.Raw(b), nil
+}
+
+func (s *RedisTokenStore) Save(ctx context.Context, name string, token bson.Raw) error {
+	_, err := s.R.Do(ctx, "SET", s.Prefix+name, []byte(token))
+	return err
+}
+
+// MongoTokenStore keeps resume tokens in a collection, one document per
+// name.
+type MongoTokenStore struct {
+	Collection *mongo.Collection
+}
+
+func NewMongoTokenStore(m *MongoDB, collection string) *MongoTokenStore {
+	return &MongoTokenStore{Collection: m.Database().Collection(collection)}
+}
+
+func (s *MongoTokenStore) Load(ctx context.Context, name string) (bson.Raw, error) {
+	var doc struct {
+		Token bson.Raw `bson:"token"`
+	}
+	err := s.Collection.FindOne(ctx, bson.D{{Key: "_id", Value: name}}).Decode(&doc)
+	if err == mongo.ErrNoDocuments {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "error loading resume token %s", name)
+	}
+	return doc.Token, nil
+}
+
+func (s *MongoTokenStore) Save(ctx context.Context, name string, token bson.Raw) error {
+	_, err := s.Collection.UpdateOne(ctx, bson.D{{Key: "_id", Value: name}},
+		bson.D{{Key: "$set", Value: bson.D{{Key: "token", Value: token}, {Key: "updated", Value: time.Now()}}}},
+		options.Update().SetUpsert(true))
+	if err != nil {
+		return errors.Wrapf(err, "error saving resume token %s", name)
+	}
+	return nil
+}
+
+type WatchOptions struct {
+	// Collection to watch; empty watches the whole database.
+	Collection string
+	// Pipeline filters or reshapes the events, e.g. a $match stage.
+	Pipeline mongo.Pipeline
+	// FullDocument looks up the current document for update events.
+	FullDocument bool
+	// Tokens persists the resume token so a restarted watcher continues
+	// where it stopped. Without it, watching starts at the current time.
+	Tokens TokenStore
+	// Name the token is saved under; defaults to the watched namespace.
+	Name string
+}
+
+// ChangeStream delivers change events on C until it is closed. A failed
+// stream is reopened from the last delivered event, backing off as
+// configured by DBOpts.Retry. A token is saved once the next event has
+// been received from C, so after a restart the last event may be delivered
+// again.
+type ChangeStream struct {
+	m      *MongoDB
+	opt    WatchOptions
+	ch     chan *ChangeEvent
+	cancel context.CancelFunc
+	done   chan struct{}
+
+	mu  sync.Mutex
+	err error
+}
+
+// Watch opens a change stream on the database, or on opt.Collection. It
+// needs a replica set or sharded cluster.
+func (m *MongoDB) Watch(ctx context.Context, opt WatchOptions) (*ChangeStream, error) {
+	if opt.Name == "" {
+		opt.Name = m.Database().Name()
+		if opt.Collection != "" {
+			opt.Name += "." + opt.Collection
+		}
+	}
+	var token bson.Raw
+	if opt.Tokens != nil {
+		var err error
+		if token, err = opt.Tokens.Load(ctx, opt.Name); err != nil {
+			return nil, err
+		}
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	cs := &ChangeStream{
+		m:      m,
+		opt:    opt,
+		ch:     make(chan *ChangeEvent),
+		cancel: cancel,
+		done:   make(chan struct{}),
+	}
+	stream, err := cs.open(ctx, token)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	go cs.run(ctx, stream, token)
+	return cs, nil
+}
+
+// C returns the channel events are delivered on. It is closed when the
+// stream ends; Err tells why.
+func (cs *ChangeStream) C() <-chan *ChangeEvent {
+	return cs.ch
+}
+
+// Err returns the error that ended the stream, nil if it was closed.
+func (cs *ChangeStream) Err() error {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	return cs.err
+}
+
+// Close ends the stream and waits for it to stop.
+func (cs *ChangeStream) Close() error {
+	cs.cancel()
+	<-cs.done
+	return nil
+}
+
+func (cs *ChangeStream) open(ctx context.Context, token bson.Raw) (*mongo.ChangeStream, error) {
+	opts := options.ChangeStream()
+	if cs.opt.FullDocument {
+		opts.SetFullDocument(options.UpdateLookup)
+	}
+	if token != nil {
+		opts.SetResumeAfter(token)
+	}
+	pipeline := cs.opt.Pipeline
+	if pipeline == nil {
+		pipeline = mongo.Pipeline{}
+	}
+	var stream *mongo.ChangeStream
+	var err error
+	if cs.opt.Collection == "" {
+		stream, err = cs.m.Database().Watch(ctx, pipeline, opts)
+	} else {
+		stream, err = cs.m.Database().Collection(cs.opt.Collection).Watch(ctx, pipeline, opts)
+	}
+	return stream, errors.Wrapf(err, "error watching %s", cs.opt.Name)
+}
+
+func (cs *ChangeStream) run(ctx context.Context, stream *mongo.ChangeStream, resume bson.Raw) {
+	defer close(cs.done)
+	defer close(cs.ch)
+
+	policy := cs.m.Opt.retryPolicy()
+	var unsaved bson.Raw
+	for {
+		err := cs.receive(ctx, stream, &resume, &unsaved)
+		stream.Close(context.Background())
+		for attempt := 1; ctx.Err() == nil; attempt++ {
+			if changeStreamFatal(err) {
+				cs.mu.Lock()
+				cs.err = err
+				cs.mu.Unlock()
+				return
+			}
+			logrus.WithError(err).WithField("attempt", attempt).Warnf("MongoDB change stream %s lost, reopening", cs.opt.Name)
+			if sleepContext(ctx, policy.Backoff(attempt)) != nil {
+				break
+			}
+			if stream, err = cs.open(ctx, resume); err == nil {
+				break
+			}
+		}
+		if ctx.Err() != nil {
+			if stream != nil {
+				stream.Close(context.Background())
+			}
+			return
+		}
+	}
+}
+
+// receive delivers events until the stream fails. resume is the token of
+// the last delivered event, unsaved the one still to be saved.
+func (cs *ChangeStream) receive(ctx context.Context, stream *mongo.ChangeStream, resume, unsaved *bson.Raw) error {
+	for stream.Next(ctx) {
+		ev := &ChangeEvent{}
+		if err := stream.Decode(ev); err != nil {
+			return errors.Wrap(err, "error decoding change event")
+		}
+		select {
+		case cs.ch <- ev:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		// the consumer is back for more, so the previous event is done
+		if cs.opt.Tokens != nil && *unsaved != nil {
+			if err := cs.opt.Tokens.Save(ctx, cs.opt.Name, *unsaved); err != nil {
+				logrus.WithError(err).Warnf("MongoDB change stream %s: resume token not saved", cs.opt.Name)
+			}
+		}
+		*resume = ev.Token
+		*unsaved = ev.Token
+	}
+	// every event so far was delivered, so the post-batch token is safe to
+	// resume from and skips events filtered out by the pipeline
+	if token := stream.ResumeToken(); token != nil {
+		*resume = token
+	}
+	if err := stream.Err(); err != nil {
+		return err
+	}
+	return ctx.Err()
+}
+
+// changeStreamFatal reports errors reopening the stream can not fix, such as
+// a resume token that fell off the oplog.
+func changeStreamFatal(err error) bool {
+	se, ok := errors.Cause(err).(mongo.ServerError)
+	if !ok || se.HasErrorLabel("ResumableChangeStreamError") {
+		return false
+	}
+	for _, code := range []int{13, 260, 280, 286} {
+		// Unauthorized, InvalidResumeToken, ChangeStreamFatalError, ChangeStreamHistoryLost
+		if se.HasErrorCode(code) {
+			return true
+		}
+	}
+	return false
+}
@@ -1,7 +1,9 @@
 package db
 
 import (
+	"context"
 	"fmt"
+	mysqldrv "github.com/go-sql-driver/mysql"
 	"github.com/golang-migrate/migrate"
 	"github.com/golang-migrate/migrate/database/mysql"
 	"github.com/golang-migrate/migrate/source"
@@ -9,7 +11,6 @@ import (
 	"github.com/jmoiron/sqlx"
 	_ "github.com/lib/pq"
 	"github.com/pkg/errors"
-	"github.com/sirupsen/logrus"
 	"log"
 	"os"
 	"time"
@@ -20,34 +21,47 @@ type MysqlDB struct {
 	Opt *DBOpts
 }
 
+func init() {
+	Register("mysql", func(opt *DBOpts) DBManager {
+		return &MysqlDB{Opt: opt}
+	})
+}
+
 func (m *MysqlDB) Connect() error {
+	return m.ConnectContext(context.Background())
+}
+
+func (m *MysqlDB) ConnectContext(ctx context.Context) error {
 	var err error
 
+	if m.Opt.TLS != nil {
+		cfg, err := m.Opt.TLS.Config(m.Opt.Host)
+		if err != nil {
+			return errors.Wrap(err, "Mysql TLS config is invalid")
+		}
+		if err := mysqldrv.RegisterTLSConfig(m.tlsConfigName(), cfg); err != nil {
+			return errors.Wrap(err, "Mysql TLS config cannot be registered")
+		}
+	}
+
 	m.DB, err = sqlx.Open("mysql", m.DBSource())
 	if err != nil {
 		return errors.Wrap(err, "Postgres connection cannot be opened")
 	}
-	const maxRetries = 6
-	for i := 1; i <= maxRetries; i++ {
-		if err = m.DB.Ping(); err != nil {
-			logrus.WithError(err).WithField("attempt", i).Warnln("Mysql not yet pinging")
-			if i < maxRetries {
-				// don't sleep on the last failure
-				time.Sleep(time.Duration(i) * time.Second)
-			}
-			continue
-		}
-		//logrus.Println("connected to Postgres")
-		if m.Opt.MaxActive > 0 {
-			m.DB.SetMaxOpenConns(m.Opt.MaxActive)
-		}
-		if m.Opt.MaxIdle > 0 {
-			m.DB.SetMaxIdleConns(m.Opt.MaxIdle)
-		}
-
-		return nil
+	err = m.Opt.retryPolicy().retry(ctx, "Mysql", func(ctx context.Context) error {
+		return m.DB.PingContext(ctx)
+	})
+	if err != nil {
+		m.DB.Close()
+		return err
 	}
 
+	if m.Opt.MaxActive > 0 {
+		m.DB.SetMaxOpenConns(m.Opt.MaxActive)
+	}
+	if m.Opt.MaxIdle > 0 {
+		m.DB.SetMaxIdleConns(m.Opt.MaxIdle)
+	}
 	return nil
 }
 
@@ -55,12 +69,39 @@ func (m *MysqlDB) Close() {
 	m.DB.Close()
 }
 
+// CloseContext prevents new queries from starting and waits for the ones
+// already running on the server to finish before closing the pool.
+func (m *MysqlDB) CloseContext(ctx context.Context) error {
+	return closeContext(ctx, m.DB.Close)
+}
+
+func (m *MysqlDB) Ping(ctx context.Context) error {
+	return m.DB.PingContext(ctx)
+}
+
+func (m *MysqlDB) Health(ctx context.Context) *Health {
+	start := time.Now()
+	err := m.Ping(ctx)
+	return newHealth(start, err, sqlPoolStats(m.DB.Stats()))
+}
+
 func (m *MysqlDB) Option() *DBOpts {
 	return m.Opt
 }
 
 func (m *MysqlDB) DBSource() string {
-	return fmt.Sprintf("%s:%s@tcp(%s:%d)/%s?parseTime=true&charset=utf8", m.Opt.User, m.Opt.Password, m.Opt.Host, m.Opt.Port, m.Opt.Database)
+	params := map[string]string{"parseTime": "true", "charset": "utf8"}
+	if m.Opt.TLS != nil {
+		params["tls"] = m.tlsConfigName()
+	}
+	return fmt.Sprintf("%s:%s@tcp(%s:%d)/%s%s", m.Opt.User, m.Opt.Password, m.Opt.Host, m.Opt.Port, m.Opt.Database,
+		m.Opt.query(params))
+}
+
+// tlsConfigName is the key the TLS config is registered under with the
+// MySQL driver, one per server.
+func (m *MysqlDB) tlsConfigName() string {
+	return fmt.Sprintf("caplibgo-%s-%d", m.Opt.Host, m.Opt.Port)
 }
 
 func NewMysql(opt *DBOpts) (*MysqlDB, error) {
@@ -1,6 +1,7 @@
 package db
 
 import (
+	"context"
 	"fmt"
 	"github.com/golang-migrate/migrate"
 	"github.com/golang-migrate/migrate/database/postgres"
@@ -9,8 +10,8 @@ import (
 	"github.com/jmoiron/sqlx"
 	_ "github.com/lib/pq"
 	"github.com/pkg/errors"
-	"github.com/sirupsen/logrus"
 	"log"
+	"net/url"
 	"os"
 	"time"
 )
@@ -20,7 +21,17 @@ type PostgresDB struct {
 	Opt *DBOpts
 }
 
+func init() {
+	Register("postgres", func(opt *DBOpts) DBManager {
+		return &PostgresDB{Opt: opt}
+	})
+}
+
 func (p *PostgresDB) Connect() error {
+	return p.ConnectContext(context.Background())
+}
+
+func (p *PostgresDB) ConnectContext(ctx context.Context) error {
 	var err error
 	//p.DB, err = sqlx.Connect("postgres", p.DBSource())
 	//if err != nil {
@@ -31,27 +42,20 @@ func (p *PostgresDB) Connect() error {
 	if err != nil {
 		return errors.Wrap(err, "Postgres connection cannot be opened")
 	}
-	const maxRetries = 6
-	for i := 1; i <= maxRetries; i++ {
-		if err = p.DB.Ping(); err != nil {
-			logrus.WithError(err).WithField("attempt", i).Warnln("Postgres not yet pinging")
-			if i < maxRetries {
-				// don't sleep on the last failure
-				time.Sleep(time.Duration(i) * time.Second)
-			}
-			continue
-		}
-		//logrus.Println("connected to Postgres")
-		if p.Opt.MaxActive > 0 {
-			p.DB.SetMaxOpenConns(p.Opt.MaxActive)
-		}
-		if p.Opt.MaxIdle > 0 {
-			p.DB.SetMaxIdleConns(p.Opt.MaxIdle)
-		}
-
-		return nil
+	err = p.Opt.retryPolicy().retry(ctx, "Postgres", func(ctx context.Context) error {
+		return p.DB.PingContext(ctx)
+	})
+	if err != nil {
+		p.DB.Close()
+		return err
 	}
 
+	if p.Opt.MaxActive > 0 {
+		p.DB.SetMaxOpenConns(p.Opt.MaxActive)
+	}
+	if p.Opt.MaxIdle > 0 {
+		p.DB.SetMaxIdleConns(p.Opt.MaxIdle)
+	}
 	return nil
 }
 
@@ -59,12 +63,38 @@ func (p *PostgresDB) Close() {
 	p.DB.Close()
 }
 
+// CloseContext prevents new queries from starting and waits for the ones
+// already running on the server to finish before closing the pool.
+func (p *PostgresDB) CloseContext(ctx context.Context) error {
+	return closeContext(ctx, p.DB.Close)
+}
+
+func (p *PostgresDB) Ping(ctx context.Context) error {
+	return p.DB.PingContext(ctx)
+}
+
+func (p *PostgresDB) Health(ctx context.Context) *Health {
+	start := time.Now()
+	err := p.Ping(ctx)
+	return newHealth(start, err, sqlPoolStats(p.DB.Stats()))
+}
+
 func (p *PostgresDB) Option() *DBOpts {
 	return p.Opt
 }
 
 func (p *PostgresDB) DBSource() string {
-	return fmt.Sprintf("postgres://%v:%v@%v:%v/%v?sslmode=disable", p.Opt.User, p.Opt.Password, p.Opt.Host, p.Opt.Port, p.Opt.Database)
+	u := url.URL{
+		Scheme: "postgres",
+		User:   url.UserPassword(p.Opt.User, p.Opt.Password),
+		Host:   fmt.Sprintf("%v:%v", p.Opt.Host, p.Opt.Port),
+		Path:   "/" + p.Opt.Database,
+	}
+	params := map[string]string{"sslmode": "disable"}
+	if p.Opt.TLS != nil {
+		params = p.Opt.TLS.postgresSSLParams()
+	}
+	return u.String() + p.Opt.query(params)
 }
 
 func NewPostgres(opt *DBOpts) (*PostgresDB, error) {
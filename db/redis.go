@@ -1,54 +1,285 @@
 package db
 
 import (
+	"context"
 	"fmt"
 	"github.com/garyburd/redigo/redis"
 	"github.com/pkg/errors"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
 type Redis struct {
 	DB  *redis.Pool
 	Opt *DBOpts
+
+	sentinel *redisSentinel
+	cluster  *redisCluster
+	// dialNode opens a connection outside the pool to the node serving
+	// key, or any node for an empty key
+	dialNode func(key string) (redis.Conn, error)
+	// held are the connections from holdConn, closed with the pool
+	heldMu sync.Mutex
+	held   map[redis.Conn]bool
+
+	scriptsMu sync.Mutex
+	scripts   []*Script
+
+	// closing makes the pool refuse new connections once Close has begun
+	closing atomic.Bool
+}
+
+func init() {
+	Register("redis", func(opt *DBOpts) DBManager {
+		return &Redis{Opt: opt}
+	})
 }
 
 func (r *Redis) Connect() error {
-	r.DB = &redis.Pool{
-		MaxIdle:     r.Opt.MaxIdle,
-		MaxActive:   r.Opt.MaxActive,
-		IdleTimeout: r.Opt.Timeout,
-		Dial: func() (redis.Conn, error) {
-			c, err := redis.Dial("tcp", r.DBSource())
+	return r.ConnectContext(context.Background())
+}
+
+// ConnectContext sets up the connection pool and pings Redis, retrying as
+// configured by DBOpts.Retry, so a manager is only returned once a connection
+// has actually been made.
+//
+// With DBOpts.MasterName set, Addrs are Sentinel addresses and every new
+// connection goes to the master they currently report. With DBOpts.Cluster
+// set, Addrs are Redis Cluster seed nodes and commands are routed by key slot.
+// Scripts added with RegisterScript are loaded once the server answers.
+func (r *Redis) ConnectContext(ctx context.Context) error {
+	r.closing.Store(false)
+	var dialOpts []redis.DialOption
+	if r.Opt.TLS != nil {
+		host := r.Opt.Host
+		if r.Opt.MasterName != "" || r.Opt.Cluster {
+			// let redigo check each node against its own address
+			host = ""
+		}
+		cfg, err := r.Opt.TLS.Config(host)
+		if err != nil {
+			return errors.Wrap(err, "Redis TLS config is invalid")
+		}
+		dialOpts = append(dialOpts, redis.DialUseTLS(true), redis.DialTLSConfig(cfg),
+			redis.DialTLSSkipVerify(cfg.InsecureSkipVerify))
+	}
+	if r.Opt.Timeout > 0 {
+		dialOpts = append(dialOpts, redis.DialConnectTimeout(r.Opt.Timeout))
+	}
+
+	testOnBorrow := func(c redis.Conn, t time.Time) error {
+		if time.Since(t) < time.Minute {
+			return nil
+		}
+		_, err := c.Do("Ping")
+		return err
+	}
+
+	var dial func() (redis.Conn, error)
+	switch {
+	case r.Opt.Cluster:
+		r.cluster = newRedisCluster(r.seedAddrs(), r.Opt, func(addr string) (redis.Conn, error) {
+			return r.dial(addr, false, dialOpts)
+		})
+		dial = func() (redis.Conn, error) {
+			return &clusterConn{cluster: r.cluster}, nil
+		}
+		// Pub/Sub messages are forwarded across the cluster, so any node
+		// will do for them
+		r.dialNode = func(key string) (redis.Conn, error) {
+			addr, err := r.cluster.randomAddr()
+			if key != "" {
+				addr, err = r.cluster.addrForSlot(keySlot(key))
+			}
 			if err != nil {
 				return nil, errors.Wrap(err, "Redis can not be connected")
 			}
-
-			if r.Opt.Authorization {
-				if _, err := c.Do("AUTH", r.Opt.Password); err != nil {
-					c.Close()
-					return nil, errors.Wrap(err, "Redis can not be connected")
-				}
+			return r.dial(addr, false, dialOpts)
+		}
+	case r.Opt.MasterName != "":
+		r.sentinel = newRedisSentinel(r.Opt.MasterName, r.seedAddrs(), dialOpts)
+		dial = func() (redis.Conn, error) {
+			addr, err := r.sentinel.masterAddr()
+			if err != nil {
+				return nil, errors.Wrap(err, "Redis can not be connected")
 			}
-
-			if _, err := c.Do("SELECT", r.Opt.Database); err != nil {
+			c, err := r.dial(addr, true, dialOpts)
+			if err != nil {
+				return nil, err
+			}
+			if err := checkRole(c, "master"); err != nil {
 				c.Close()
 				return nil, errors.Wrap(err, "Redis can not be connected")
 			}
-			return c, err
-		},
-		TestOnBorrow: func(c redis.Conn, t time.Time) error {
+			return c, nil
+		}
+		// a failover demotes the old master, so re-check the role rather
+		// than only pinging
+		testOnBorrow = func(c redis.Conn, t time.Time) error {
 			if time.Since(t) < time.Minute {
 				return nil
 			}
-			_, err := c.Do("Ping")
-			return err
+			return checkRole(c, "master")
+		}
+	default:
+		dial = func() (redis.Conn, error) {
+			return r.dial(r.DBSource(), true, dialOpts)
+		}
+	}
+
+	if r.dialNode == nil {
+		r.dialNode = func(string) (redis.Conn, error) { return dial() }
+	}
+	r.DB = &redis.Pool{
+		MaxIdle:     r.Opt.MaxIdle,
+		MaxActive:   r.Opt.MaxActive,
+		IdleTimeout: r.Opt.Timeout,
+		Dial: func() (redis.Conn, error) {
+			if r.closing.Load() {
+				return nil, ErrPoolClosing
+			}
+			return dial()
+		},
+		TestOnBorrow: func(c redis.Conn, t time.Time) error {
+			if r.closing.Load() {
+				return ErrPoolClosing
+			}
+			return testOnBorrow(c, t)
 		},
 	}
+	if err := r.Opt.retryPolicy().retry(ctx, "Redis", r.Ping); err != nil {
+		r.Close()
+		return err
+	}
+	if err := r.loadScripts(ctx); err != nil {
+		r.Close()
+		return err
+	}
 	return nil
 }
 
+// dial connects to a single Redis server, authenticates and, unless talking
+// to a cluster node, selects the configured database.
+func (r *Redis) dial(addr string, selectDB bool, dialOpts []redis.DialOption) (redis.Conn, error) {
+	c, err := redis.Dial("tcp", addr, dialOpts...)
+	if err != nil {
+		return nil, errors.Wrap(err, "Redis can not be connected")
+	}
+
+	if r.Opt.Authorization {
+		if _, err := c.Do("AUTH", r.Opt.Password); err != nil {
+			c.Close()
+			return nil, errors.Wrap(err, "Redis can not be connected")
+		}
+	}
+
+	if selectDB && r.Opt.Database != "" {
+		if _, err := c.Do("SELECT", r.Opt.Database); err != nil {
+			c.Close()
+			return nil, errors.Wrap(err, "Redis can not be connected")
+		}
+	}
+	return c, nil
+}
+
+// seedAddrs returns DBOpts.Addrs, falling back to Host and Port.
+func (r *Redis) seedAddrs() []string {
+	if len(r.Opt.Addrs) > 0 {
+		return r.Opt.Addrs
+	}
+	return []string{r.DBSource()}
+}
+
+// holdConn dials a connection outside the pool for commands that keep it
+// busy for long, such as Pub/Sub and blocking reads. Close and CloseContext
+// close it; hand it back with releaseConn.
+func (r *Redis) holdConn(key string) (redis.Conn, error) {
+	if r.closing.Load() {
+		return nil, ErrPoolClosing
+	}
+	c, err := r.dialNode(key)
+	if err != nil {
+		return nil, err
+	}
+	r.heldMu.Lock()
+	defer r.heldMu.Unlock()
+	if r.closing.Load() {
+		c.Close()
+		return nil, ErrPoolClosing
+	}
+	if r.held == nil {
+		r.held = make(map[redis.Conn]bool)
+	}
+	r.held[c] = true
+	return c, nil
+}
+
+func (r *Redis) releaseConn(c redis.Conn) {
+	r.heldMu.Lock()
+	delete(r.held, c)
+	r.heldMu.Unlock()
+	c.Close()
+}
+
+// closeHeld closes the connections from holdConn, interrupting whatever
+// they are blocked on.
+func (r *Redis) closeHeld() {
+	r.heldMu.Lock()
+	defer r.heldMu.Unlock()
+	for c := range r.held {
+		c.Close()
+	}
+	r.held = nil
+}
+
 func (r *Redis) Close() {
+	r.closing.Store(true)
+	r.closeHeld()
 	r.DB.Close()
+	if r.cluster != nil {
+		r.cluster.close()
+	}
+}
+
+// CloseContext stops handing out connections, so Get and every command
+// fail with ErrPoolClosing, and ends subscriptions and stream workers. It
+// then waits until the connections already checked out have been returned
+// and closes the pool.
+func (r *Redis) CloseContext(ctx context.Context) error {
+	r.closing.Store(true)
+	r.closeHeld()
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+	for r.DB.ActiveCount() > r.DB.IdleCount() {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			go r.Close()
+			return ctx.Err()
+		}
+	}
+	err := r.DB.Close()
+	if r.cluster != nil {
+		r.cluster.close()
+	}
+	return err
+}
+
+func (r *Redis) Ping(ctx context.Context) error {
+	_, err := r.do(ctx, "PING")
+	return err
+}
+
+func (r *Redis) Health(ctx context.Context) *Health {
+	start := time.Now()
+	err := r.Ping(ctx)
+	s := r.DB.Stats()
+	return newHealth(start, err, PoolStats{
+		Open:  s.ActiveCount,
+		InUse: s.ActiveCount - s.IdleCount,
+		Idle:  s.IdleCount,
+	})
 }
 
 func (r *Redis) Option() *DBOpts {
@@ -68,31 +299,101 @@ func NewRedis(opt *DBOpts) (*Redis, error) {
 	return m, nil
 }
 
+var (
+	// ErrCacheMiss is returned when a key, field or member does not exist.
+	ErrCacheMiss = errors.New("cache miss")
+	// ErrNotSet is returned by Set when SetIfNotExists or SetIfExists kept
+	// the value from being written.
+	ErrNotSet = errors.New("value not set")
+	// ErrPoolClosing is returned for connections requested while the pool
+	// is being closed.
+	ErrPoolClosing = errors.New("redis pool is closing")
+)
+
+// Get returns the value of key, or ErrCacheMiss if it does not exist.
 func (r *Redis) Get(key string) ([]byte, error) {
 	conn := r.DB.Get()
 	defer conn.Close()
-	return redis.Bytes(conn.Do("GET", key))
+	b, err := redis.Bytes(conn.Do("GET", key))
+	if err == redis.ErrNil {
+		return nil, ErrCacheMiss
+	}
+	return b, err
+}
+
+type setOptions struct {
+	cond    string
+	keepTTL bool
+	expiry  time.Duration
+}
+
+// SetOption changes how Set writes a value.
+type SetOption func(*setOptions)
+
+// SetIfNotExists only writes the value if the key does not exist yet (NX).
+func SetIfNotExists() SetOption {
+	return func(o *setOptions) { o.cond = "NX" }
+}
+
+// SetIfExists only writes the value if the key already exists (XX).
+func SetIfExists() SetOption {
+	return func(o *setOptions) { o.cond = "XX" }
+}
+
+// SetKeepTTL keeps the current expiry of the key instead of clearing it
+// (KEEPTTL, Redis 6.0 and later). The exp argument of Set is ignored.
+func SetKeepTTL() SetOption {
+	return func(o *setOptions) { o.keepTTL = true }
 }
 
-func (r *Redis) Set(key string, val string, exp int64) error {
+// SetExpiry sets the expiry with millisecond precision (PX) instead of the
+// exp argument of Set.
+func SetExpiry(d time.Duration) SetOption {
+	return func(o *setOptions) { o.expiry = d }
+}
+
+// Set writes val to key with a single SET command. exp is the expiry in
+// seconds; zero or less means none. If a SetIfNotExists or SetIfExists
+// condition is not met, Set returns ErrNotSet.
+func (r *Redis) Set(key string, val string, exp int64, opts ...SetOption) error {
+	var o setOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	args := redis.Args{key, val}
+	switch {
+	case o.keepTTL:
+		args = args.Add("KEEPTTL")
+	case o.expiry > 0:
+		args = args.Add("PX", Millis(o.expiry))
+	case exp > 0:
+		args = args.Add("EX", exp)
+	}
+	if o.cond != "" {
+		args = args.Add(o.cond)
+	}
+
 	conn := r.DB.Get()
 	defer conn.Close()
-	_, err := conn.Do("SET", key, val)
-	if exp > 0 {
-		_, err = conn.Do("EXPIRE", key, exp)
+	reply, err := conn.Do("SET", args...)
+	if err != nil {
+		return err
 	}
-	return err
+	if reply == nil {
+		return ErrNotSet
+	}
+	return nil
 }
 
-func (r *Redis) IsExist(key string) bool {
+func (r *Redis) IsExist(key string) (bool, error) {
 	conn := r.DB.Get()
 	defer conn.Close()
-	a, _ := conn.Do("EXISTS", key)
-	i := a.(int64)
-	if i > 0 {
-		return true
+	n, err := redis.Int64(conn.Do("EXISTS", key))
+	if err != nil {
+		return false, err
 	}
-	return false
+	return n > 0, nil
 }
 
 func (r *Redis) Delete(key string) error {
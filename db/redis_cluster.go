@@ -0,0 +1,549 @@
+package db
+
+import (
+	"fmt"
+	"github.com/garyburd/redigo/redis"
+	"github.com/pkg/errors"
+	"math/rand"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	clusterSlots        = 16384
+	clusterMaxRedirects = 5
+)
+
+// redisCluster keeps the slot to node map of a Redis Cluster and a
+// connection pool per node.
+type redisCluster struct {
+	seeds []string
+	opt   *DBOpts
+	dial  func(addr string) (redis.Conn, error)
+
+	mu      sync.RWMutex
+	slots   [clusterSlots]string
+	nodes   []string // distinct owners of slots, kept in step with slots
+	pools   map[string]*redis.Pool
+	loading atomic.Bool
+}
+
+func newRedisCluster(seeds []string, opt *DBOpts, dial func(addr string) (redis.Conn, error)) *redisCluster {
+	return &redisCluster{
+		seeds: seeds,
+		opt:   opt,
+		dial:  dial,
+		pools: make(map[string]*redis.Pool),
+	}
+}
+
+func (c *redisCluster) pool(addr string) *redis.Pool {
+	c.mu.RLock()
+	p, ok := c.pools[addr]
+	c.mu.RUnlock()
+	if ok {
+		return p
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if p, ok := c.pools[addr]; ok {
+		return p
+	}
+	p = &redis.Pool{
+		MaxIdle:     c.opt.MaxIdle,
+		MaxActive:   c.opt.MaxActive,
+		IdleTimeout: c.opt.Timeout,
+		Dial: func() (redis.Conn, error) {
+			return c.dial(addr)
+		},
+	}
+	c.pools[addr] = p
+	return p
+}
+
+// refresh reloads the slot map with CLUSTER SLOTS from the first node that
+// answers, trying known nodes before the seeds.
+func (c *redisCluster) refresh() error {
+	var errs []string
+	for _, addr := range c.candidates() {
+		conn := c.pool(addr).Get()
+		res, err := redis.Values(conn.Do("CLUSTER", "SLOTS"))
+		conn.Close()
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %v", addr, err))
+			continue
+		}
+
+		var slots [clusterSlots]string
+		var nodes []string
+		for _, r := range res {
+			rng, err := redis.Values(r, nil)
+			if err != nil || len(rng) < 3 {
+				continue
+			}
+			start, _ := redis.Int(rng[0], nil)
+			end, _ := redis.Int(rng[1], nil)
+			master, err := redis.Values(rng[2], nil)
+			if err != nil || len(master) < 2 {
+				continue
+			}
+			host, _ := redis.String(master[0], nil)
+			port, _ := redis.Int(master[1], nil)
+			if host == "" {
+				// the node we asked leaves its own address empty
+				host, _, _ = net.SplitHostPort(addr)
+			}
+			node := net.JoinHostPort(host, strconv.Itoa(port))
+			if !containsString(nodes, node) {
+				nodes = append(nodes, node)
+			}
+			for slot := start; slot <= end && slot < clusterSlots; slot++ {
+				slots[slot] = node
+			}
+		}
+
+		c.mu.Lock()
+		c.slots, c.nodes = slots, nodes
+		c.mu.Unlock()
+		return nil
+	}
+	return fmt.Errorf("can not load cluster slots (%s)", strings.Join(errs, "; "))
+}
+
+// refreshAsync reloads the slot map in the background unless a reload
+// started this way is still running.
+func (c *redisCluster) refreshAsync() {
+	if !c.loading.CompareAndSwap(false, true) {
+		return
+	}
+	go func() {
+		defer c.loading.Store(false)
+		c.refresh()
+	}()
+}
+
+func (c *redisCluster) candidates() []string {
+	addrs := c.masters()
+	for _, addr := range c.seeds {
+		if !containsString(addrs, addr) {
+			addrs = append(addrs, addr)
+		}
+	}
+	return addrs
+}
+
+// masters returns the distinct nodes that currently own slots.
+func (c *redisCluster) masters() []string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return append([]string(nil), c.nodes...)
+}
+
+func (c *redisCluster) addrForSlot(slot int) (string, error) {
+	c.mu.RLock()
+	addr := c.slots[slot]
+	c.mu.RUnlock()
+	if addr != "" {
+		return addr, nil
+	}
+	if err := c.refresh(); err != nil {
+		return "", err
+	}
+	c.mu.RLock()
+	addr = c.slots[slot]
+	c.mu.RUnlock()
+	if addr == "" {
+		return "", fmt.Errorf("no cluster node serves slot %d", slot)
+	}
+	return addr, nil
+}
+
+func (c *redisCluster) randomAddr() (string, error) {
+	masters := c.masters()
+	if len(masters) == 0 {
+		if err := c.refresh(); err != nil {
+			return "", err
+		}
+		if masters = c.masters(); len(masters) == 0 {
+			return "", errors.New("cluster has no nodes serving slots")
+		}
+	}
+	return masters[rand.Intn(len(masters))], nil
+}
+
+func (c *redisCluster) setSlot(slot int, addr string) {
+	c.mu.Lock()
+	c.slots[slot] = addr
+	if !containsString(c.nodes, addr) {
+		c.nodes = append(c.nodes, addr)
+	}
+	c.mu.Unlock()
+}
+
+// redirected updates the slot map after a MOVED reply to a command sent
+// outside do.
+func (c *redisCluster) redirected(err error) {
+	rerr, ok := err.(redis.Error)
+	if !ok {
+		return
+	}
+	if kind, slot, target, ok := parseRedirect(rerr); ok && kind == "MOVED" {
+		c.setSlot(slot, target)
+		c.refreshAsync()
+	}
+}
+
+// addrFor picks the node for a command: the owner of the key's slot, or any
+// master for commands without a key.
+func (c *redisCluster) addrFor(cmd string, args []interface{}) (string, error) {
+	key, ok := commandKey(cmd, args)
+	if !ok {
+		return c.randomAddr()
+	}
+	return c.addrForSlot(keySlot(key))
+}
+
+// do runs one command, following MOVED and ASK redirects.
+func (c *redisCluster) do(timeout time.Duration, cmd string, args ...interface{}) (interface{}, error) {
+	switch strings.ToUpper(cmd) {
+	case "FLUSHDB", "FLUSHALL", "SCRIPT":
+		return c.broadcast(timeout, cmd, args...)
+	}
+
+	addr, err := c.addrFor(cmd, args)
+	if err != nil {
+		return nil, err
+	}
+	asking := false
+	for i := 0; ; i++ {
+		reply, err := c.doOn(addr, asking, timeout, cmd, args...)
+		rerr, ok := err.(redis.Error)
+		if !ok || i >= clusterMaxRedirects {
+			return reply, err
+		}
+		kind, slot, target, ok := parseRedirect(rerr)
+		if !ok {
+			return reply, err
+		}
+		switch kind {
+		case "MOVED":
+			c.setSlot(slot, target)
+			// the whole map has probably changed, reload it in the background
+			c.refreshAsync()
+			asking = false
+		case "ASK":
+			asking = true
+		}
+		addr = target
+	}
+}
+
+func (c *redisCluster) doOn(addr string, asking bool, timeout time.Duration, cmd string, args ...interface{}) (interface{}, error) {
+	conn := c.pool(addr).Get()
+	defer conn.Close()
+	if asking {
+		if _, err := conn.Do("ASKING"); err != nil {
+			return nil, err
+		}
+	}
+	return redis.DoWithTimeout(conn, timeout, cmd, args...)
+}
+
+// loadedMasters is masters, loading the slot map first if it is empty.
+func (c *redisCluster) loadedMasters() ([]string, error) {
+	if masters := c.masters(); len(masters) > 0 {
+		return masters, nil
+	}
+	if err := c.refresh(); err != nil {
+		return nil, err
+	}
+	return c.masters(), nil
+}
+
+// broadcast runs cmd on every master and returns the first error, or the
+// reply of the last node.
+func (c *redisCluster) broadcast(timeout time.Duration, cmd string, args ...interface{}) (interface{}, error) {
+	masters, err := c.loadedMasters()
+	if err != nil {
+		return nil, err
+	}
+	var reply interface{}
+	for _, addr := range masters {
+		var err error
+		if reply, err = c.doOn(addr, false, timeout, cmd, args...); err != nil {
+			return nil, err
+		}
+	}
+	return reply, nil
+}
+
+func (c *redisCluster) close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, p := range c.pools {
+		p.Close()
+	}
+	c.pools = make(map[string]*redis.Pool)
+}
+
+// parseRedirect parses "MOVED 3999 127.0.0.1:6381" and "ASK ..." errors.
+func parseRedirect(err redis.Error) (kind string, slot int, addr string, ok bool) {
+	parts := strings.Fields(string(err))
+	if len(parts) != 3 || (parts[0] != "MOVED" && parts[0] != "ASK") {
+		return "", 0, "", false
+	}
+	slot, convErr := strconv.Atoi(parts[1])
+	if convErr != nil {
+		return "", 0, "", false
+	}
+	return parts[0], slot, parts[2], true
+}
+
+// commandKey returns the key a command is routed by.
+func commandKey(cmd string, args []interface{}) (string, bool) {
+	pos := 0
+	switch strings.ToUpper(cmd) {
+	case "PING", "ECHO", "INFO", "TIME", "DBSIZE", "RANDOMKEY", "SCAN", "MULTI", "EXEC", "DISCARD", "UNWATCH", "ROLE", "CLUSTER":
+		return "", false
+	case "EVAL", "EVALSHA":
+		// EVAL script numkeys key...
+		if len(args) < 3 {
+			return "", false
+		}
+		if n, err := redis.Int(args[1], nil); err != nil || n == 0 {
+			return "", false
+		}
+		pos = 2
+	case "XGROUP", "XINFO", "OBJECT":
+		// XGROUP CREATE key ..., XINFO STREAM key, OBJECT ENCODING key
+		pos = 1
+	case "XREAD", "XREADGROUP":
+		for i, a := range args {
+			if s, ok := a.(string); ok && strings.ToUpper(s) == "STREAMS" && i+1 < len(args) {
+				pos = i + 1
+				break
+			}
+		}
+	}
+	if len(args) <= pos {
+		return "", false
+	}
+	switch k := args[pos].(type) {
+	case string:
+		return k, true
+	case []byte:
+		return string(k), true
+	default:
+		return fmt.Sprint(k), true
+	}
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// keySlot returns the cluster slot of key, honouring {hash tags}.
+func keySlot(key string) int {
+	if i := strings.IndexByte(key, '{'); i >= 0 {
+		if j := strings.IndexByte(key[i+1:], '}'); j > 0 {
+			key = key[i+1 : i+1+j]
+		}
+	}
+	return int(crc16(key) % clusterSlots)
+}
+
+// crc16 is the CRC16-CCITT (XMODEM) checksum Redis Cluster uses.
+func crc16(s string) uint16 {
+	var crc uint16
+	for i := 0; i < len(s); i++ {
+		crc ^= uint16(s[i]) << 8
+		for j := 0; j < 8; j++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
+
+// clusterConn is the redis.Conn handed out by Redis.DB in cluster mode. Do
+// routes each command to the node owning its key. Send, Flush and Receive
+// are supported by running the queued commands one by one on Flush.
+//
+// WATCH and MULTI pin the connection to a single node until EXEC, DISCARD or
+// UNWATCH, so transactions work as long as their keys share a slot. A MULTI
+// without a preceding WATCH pins to the node of the first queued key.
+type clusterConn struct {
+	cluster *redisCluster
+	pending []clusterCmd
+	replies []clusterReply
+	err     error
+
+	pinned   redis.Conn
+	pinMulti bool
+}
+
+type clusterCmd struct {
+	name string
+	args []interface{}
+}
+
+type clusterReply struct {
+	reply interface{}
+	err   error
+}
+
+func (c *clusterConn) Close() error {
+	c.pending, c.replies = nil, nil
+	c.pinMulti = false
+	c.unpin()
+	return nil
+}
+
+func (c *clusterConn) Err() error {
+	if c.err == nil && c.pinned != nil {
+		return c.pinned.Err()
+	}
+	return c.err
+}
+
+func (c *clusterConn) pin(cmd string, args []interface{}) error {
+	addr, err := c.cluster.addrFor(cmd, args)
+	if err != nil {
+		return err
+	}
+	c.pinned = c.cluster.pool(addr).Get()
+	return nil
+}
+
+func (c *clusterConn) unpin() {
+	if c.pinned != nil {
+		c.pinned.Close()
+		c.pinned = nil
+	}
+}
+
+// afterPinned releases the pinned node once a transaction is over.
+func (c *clusterConn) afterPinned(cmd string) {
+	switch strings.ToUpper(cmd) {
+	case "EXEC", "DISCARD", "UNWATCH":
+		c.unpin()
+	}
+}
+
+func (c *clusterConn) Do(cmd string, args ...interface{}) (interface{}, error) {
+	return c.DoWithTimeout(0, cmd, args...)
+}
+
+func (c *clusterConn) DoWithTimeout(timeout time.Duration, cmd string, args ...interface{}) (interface{}, error) {
+	if c.pinned == nil && strings.ToUpper(cmd) == "WATCH" {
+		if err := c.pin(cmd, args); err != nil {
+			return nil, err
+		}
+	}
+	if c.pinned != nil {
+		defer c.afterPinned(cmd)
+		return redis.DoWithTimeout(c.pinned, timeout, cmd, args...)
+	}
+
+	if cmd == "" {
+		// Do("") flushes pending commands and returns all replies
+		if err := c.flush(timeout); err != nil {
+			return nil, err
+		}
+		replies := make([]interface{}, len(c.replies))
+		for i, r := range c.replies {
+			if r.err != nil {
+				replies[i] = r.err
+			} else {
+				replies[i] = r.reply
+			}
+		}
+		c.replies = nil
+		return replies, nil
+	}
+	if len(c.pending) > 0 || len(c.replies) > 0 {
+		if err := c.flush(timeout); err != nil {
+			return nil, err
+		}
+		c.replies = nil
+	}
+	return c.cluster.do(timeout, cmd, args...)
+}
+
+func (c *clusterConn) Send(cmd string, args ...interface{}) error {
+	if c.pinned == nil {
+		switch {
+		case strings.ToUpper(cmd) == "MULTI":
+			c.pinMulti = true
+			return nil
+		case c.pinMulti:
+			if _, ok := commandKey(cmd, args); ok {
+				if err := c.pin(cmd, args); err != nil {
+					return err
+				}
+				c.pinMulti = false
+				if err := c.pinned.Send("MULTI"); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	if c.pinned != nil {
+		return c.pinned.Send(cmd, args...)
+	}
+	c.pending = append(c.pending, clusterCmd{cmd, args})
+	return nil
+}
+
+func (c *clusterConn) Flush() error {
+	if c.pinned != nil {
+		return c.pinned.Flush()
+	}
+	return c.flush(0)
+}
+
+func (c *clusterConn) flush(timeout time.Duration) error {
+	for _, cmd := range c.pending {
+		reply, err := c.cluster.do(timeout, cmd.name, cmd.args...)
+		if _, ok := err.(redis.Error); err != nil && !ok {
+			c.err = err
+		}
+		c.replies = append(c.replies, clusterReply{reply, err})
+	}
+	c.pending = nil
+	return c.err
+}
+
+func (c *clusterConn) Receive() (interface{}, error) {
+	return c.ReceiveWithTimeout(0)
+}
+
+func (c *clusterConn) ReceiveWithTimeout(timeout time.Duration) (interface{}, error) {
+	if c.pinned != nil {
+		return redis.ReceiveWithTimeout(c.pinned, timeout)
+	}
+	if len(c.pending) > 0 {
+		if err := c.flush(timeout); err != nil {
+			return nil, err
+		}
+	}
+	if len(c.replies) == 0 {
+		return nil, errors.New("redis cluster: Receive without a pending reply")
+	}
+	r := c.replies[0]
+	c.replies = c.replies[1:]
+	return r.reply, r.err
+}
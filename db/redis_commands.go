@@ -0,0 +1,494 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"github.com/garyburd/redigo/redis"
+	"strconv"
+	"time"
+)
+
+// CommandError is returned by the typed Redis helpers. Err is the redigo or
+// server error. Missing keys are reported as ErrCacheMiss instead.
+type CommandError struct {
+	Cmd string
+	Key string
+	Err error
+}
+
+func (e *CommandError) Error() string {
+	if e.Key == "" {
+		return fmt.Sprintf("redis %s: %v", e.Cmd, e.Err)
+	}
+	return fmt.Sprintf("redis %s %s: %v", e.Cmd, e.Key, e.Err)
+}
+
+func (e *CommandError) Cause() error { return e.Err }
+
+func (e *CommandError) Unwrap() error { return e.Err }
+
+func cmdError(cmd, key string, err error) error {
+	if err == nil {
+		return nil
+	}
+	if err == redis.ErrNil {
+		return ErrCacheMiss
+	}
+	if _, ok := err.(*CommandError); ok {
+		return err
+	}
+	return &CommandError{Cmd: cmd, Key: key, Err: err}
+}
+
+// NoExpiry is returned by TTL for keys without an expiry.
+const NoExpiry time.Duration = -1
+
+// Millis converts d to the milliseconds taken by PX, PEXPIRE and the like.
+// A positive duration is rounded up, so it never turns into 0, which Redis
+// rejects or treats as "expire now".
+func Millis(d time.Duration) int64 {
+	if d <= 0 {
+		return int64(d / time.Millisecond)
+	}
+	return int64((d + time.Millisecond - 1) / time.Millisecond)
+}
+
+// ctxTimeout turns the ctx deadline into a read timeout for redigo. Zero
+// means no timeout beyond the connection defaults.
+func ctxTimeout(ctx context.Context) (time.Duration, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return 0, nil
+	}
+	timeout := time.Until(deadline)
+	if timeout <= 0 {
+		return 0, context.DeadlineExceeded
+	}
+	return timeout, nil
+}
+
+// do runs a single command on a pooled connection, bounded by ctx.
+func (r *Redis) do(ctx context.Context, cmd string, args ...interface{}) (interface{}, error) {
+	conn, err := r.DB.GetContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	timeout, err := ctxTimeout(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return redis.DoWithTimeout(conn, timeout, cmd, args...)
+}
+
+// Do runs any command, bounded by ctx, and returns the raw reply. Use the
+// redigo helpers such as redis.Bytes to convert it.
+func (r *Redis) Do(ctx context.Context, cmd string, args ...interface{}) (interface{}, error) {
+	reply, err := r.do(ctx, cmd, args...)
+	key, _ := commandKey(cmd, args)
+	return reply, cmdError(cmd, key, err)
+}
+
+// Keys
+
+// Expire sets a timeout on key. It reports false if the key does not exist.
+func (r *Redis) Expire(ctx context.Context, key string, ttl time.Duration) (bool, error) {
+	ok, err := redis.Bool(r.do(ctx, "PEXPIRE", key, Millis(ttl)))
+	return ok, cmdError("PEXPIRE", key, err)
+}
+
+// TTL returns the remaining time to live of key, or NoExpiry if it has none.
+// A missing key is reported as ErrCacheMiss.
+func (r *Redis) TTL(ctx context.Context, key string) (time.Duration, error) {
+	ms, err := redis.Int64(r.do(ctx, "PTTL", key))
+	if err != nil {
+		return 0, cmdError("PTTL", key, err)
+	}
+	switch ms {
+	case -2:
+		return 0, ErrCacheMiss
+	case -1:
+		return NoExpiry, nil
+	}
+	return time.Duration(ms) * time.Millisecond, nil
+}
+
+// Persist removes the timeout of key. It reports false if the key does not
+// exist or had no timeout.
+func (r *Redis) Persist(ctx context.Context, key string) (bool, error) {
+	ok, err := redis.Bool(r.do(ctx, "PERSIST", key))
+	return ok, cmdError("PERSIST", key, err)
+}
+
+// Strings
+
+// MGet returns the values of keys in order, with nil for missing keys.
+func (r *Redis) MGet(ctx context.Context, keys ...string) ([][]byte, error) {
+	vals, err := redis.ByteSlices(r.do(ctx, "MGET", redis.Args{}.AddFlat(keys)...))
+	return vals, cmdError("MGET", "", err)
+}
+
+func (r *Redis) MSet(ctx context.Context, pairs map[string]interface{}) error {
+	_, err := r.do(ctx, "MSET", redis.Args{}.AddFlat(pairs)...)
+	return cmdError("MSET", "", err)
+}
+
+// SetNX sets key only if it does not exist yet and reports whether it did.
+// A ttl of zero means no expiry.
+func (r *Redis) SetNX(ctx context.Context, key string, val interface{}, ttl time.Duration) (bool, error) {
+	args := redis.Args{key, val, "NX"}
+	if ttl > 0 {
+		args = args.Add("PX", Millis(ttl))
+	}
+	reply, err := redis.String(r.do(ctx, "SET", args...))
+	if err == redis.ErrNil {
+		return false, nil
+	}
+	return reply == "OK", cmdError("SET", key, err)
+}
+
+// GetSet sets key to val and returns the old value.
+func (r *Redis) GetSet(ctx context.Context, key string, val interface{}) ([]byte, error) {
+	b, err := redis.Bytes(r.do(ctx, "GETSET", key, val))
+	return b, cmdError("GETSET", key, err)
+}
+
+// Hashes
+
+func (r *Redis) HGet(ctx context.Context, key, field string) ([]byte, error) {
+	b, err := redis.Bytes(r.do(ctx, "HGET", key, field))
+	return b, cmdError("HGET", key, err)
+}
+
+// HSet sets field in the hash at key and reports whether the field is new.
+func (r *Redis) HSet(ctx context.Context, key, field string, val interface{}) (bool, error) {
+	n, err := redis.Int64(r.do(ctx, "HSET", key, field, val))
+	return n == 1, cmdError("HSET", key, err)
+}
+
+// HSetStruct stores the exported fields of the struct v in the hash at key,
+// using the redis:"name" field tags like redigo's ScanStruct.
+func (r *Redis) HSetStruct(ctx context.Context, key string, v interface{}) error {
+	_, err := r.do(ctx, "HMSET", redis.Args{key}.AddFlat(v)...)
+	return cmdError("HMSET", key, err)
+}
+
+// HGetAll loads the hash at key into the struct pointed to by dest. A missing
+// key is reported as ErrCacheMiss.
+func (r *Redis) HGetAll(ctx context.Context, key string, dest interface{}) error {
+	vals, err := redis.Values(r.do(ctx, "HGETALL", key))
+	if err != nil {
+		return cmdError("HGETALL", key, err)
+	}
+	if len(vals) == 0 {
+		return ErrCacheMiss
+	}
+	return cmdError("HGETALL", key, redis.ScanStruct(vals, dest))
+}
+
+// HGetAllMap returns the hash at key as a map, empty if it does not exist.
+func (r *Redis) HGetAllMap(ctx context.Context, key string) (map[string]string, error) {
+	m, err := redis.StringMap(r.do(ctx, "HGETALL", key))
+	return m, cmdError("HGETALL", key, err)
+}
+
+func (r *Redis) HDel(ctx context.Context, key string, fields ...string) (int64, error) {
+	n, err := redis.Int64(r.do(ctx, "HDEL", redis.Args{key}.AddFlat(fields)...))
+	return n, cmdError("HDEL", key, err)
+}
+
+func (r *Redis) HExists(ctx context.Context, key, field string) (bool, error) {
+	ok, err := redis.Bool(r.do(ctx, "HEXISTS", key, field))
+	return ok, cmdError("HEXISTS", key, err)
+}
+
+func (r *Redis) HIncrBy(ctx context.Context, key, field string, incr int64) (int64, error) {
+	n, err := redis.Int64(r.do(ctx, "HINCRBY", key, field, incr))
+	return n, cmdError("HINCRBY", key, err)
+}
+
+// Lists
+
+func (r *Redis) LPush(ctx context.Context, key string, vals ...interface{}) (int64, error) {
+	n, err := redis.Int64(r.do(ctx, "LPUSH", redis.Args{key}.Add(vals...)...))
+	return n, cmdError("LPUSH", key, err)
+}
+
+func (r *Redis) RPush(ctx context.Context, key string, vals ...interface{}) (int64, error) {
+	n, err := redis.Int64(r.do(ctx, "RPUSH", redis.Args{key}.Add(vals...)...))
+	return n, cmdError("RPUSH", key, err)
+}
+
+// LPop removes and returns the first element of the list at key. An empty
+// list is reported as ErrCacheMiss.
+func (r *Redis) LPop(ctx context.Context, key string) ([]byte, error) {
+	b, err := redis.Bytes(r.do(ctx, "LPOP", key))
+	return b, cmdError("LPOP", key, err)
+}
+
+// RPop removes and returns the last element of the list at key. An empty
+// list is reported as ErrCacheMiss.
+func (r *Redis) RPop(ctx context.Context, key string) ([]byte, error) {
+	b, err := redis.Bytes(r.do(ctx, "RPOP", key))
+	return b, cmdError("RPOP", key, err)
+}
+
+func (r *Redis) LRange(ctx context.Context, key string, start, stop int64) ([][]byte, error) {
+	vals, err := redis.ByteSlices(r.do(ctx, "LRANGE", key, start, stop))
+	return vals, cmdError("LRANGE", key, err)
+}
+
+func (r *Redis) LLen(ctx context.Context, key string) (int64, error) {
+	n, err := redis.Int64(r.do(ctx, "LLEN", key))
+	return n, cmdError("LLEN", key, err)
+}
+
+func (r *Redis) LTrim(ctx context.Context, key string, start, stop int64) error {
+	_, err := r.do(ctx, "LTRIM", key, start, stop)
+	return cmdError("LTRIM", key, err)
+}
+
+// Sets
+
+func (r *Redis) SAdd(ctx context.Context, key string, members ...interface{}) (int64, error) {
+	n, err := redis.Int64(r.do(ctx, "SADD", redis.Args{key}.Add(members...)...))
+	return n, cmdError("SADD", key, err)
+}
+
+func (r *Redis) SRem(ctx context.Context, key string, members ...interface{}) (int64, error) {
+	n, err := redis.Int64(r.do(ctx, "SREM", redis.Args{key}.Add(members...)...))
+	return n, cmdError("SREM", key, err)
+}
+
+func (r *Redis) SMembers(ctx context.Context, key string) ([]string, error) {
+	vals, err := redis.Strings(r.do(ctx, "SMEMBERS", key))
+	return vals, cmdError("SMEMBERS", key, err)
+}
+
+func (r *Redis) SIsMember(ctx context.Context, key string, member interface{}) (bool, error) {
+	ok, err := redis.Bool(r.do(ctx, "SISMEMBER", key, member))
+	return ok, cmdError("SISMEMBER", key, err)
+}
+
+func (r *Redis) SCard(ctx context.Context, key string) (int64, error) {
+	n, err := redis.Int64(r.do(ctx, "SCARD", key))
+	return n, cmdError("SCARD", key, err)
+}
+
+// Sorted sets
+
+// Z is a sorted set member with its score.
+type Z struct {
+	Member string
+	Score  float64
+}
+
+func (r *Redis) ZAdd(ctx context.Context, key string, members ...Z) (int64, error) {
+	args := redis.Args{key}
+	for _, z := range members {
+		args = args.Add(z.Score, z.Member)
+	}
+	n, err := redis.Int64(r.do(ctx, "ZADD", args...))
+	return n, cmdError("ZADD", key, err)
+}
+
+func (r *Redis) ZRem(ctx context.Context, key string, members ...interface{}) (int64, error) {
+	n, err := redis.Int64(r.do(ctx, "ZREM", redis.Args{key}.Add(members...)...))
+	return n, cmdError("ZREM", key, err)
+}
+
+// ZScore returns the score of member. A missing member is reported as
+// ErrCacheMiss.
+func (r *Redis) ZScore(ctx context.Context, key, member string) (float64, error) {
+	f, err := redis.Float64(r.do(ctx, "ZSCORE", key, member))
+	return f, cmdError("ZSCORE", key, err)
+}
+
+func (r *Redis) ZIncrBy(ctx context.Context, key string, incr float64, member string) (float64, error) {
+	f, err := redis.Float64(r.do(ctx, "ZINCRBY", key, incr, member))
+	return f, cmdError("ZINCRBY", key, err)
+}
+
+func (r *Redis) ZCard(ctx context.Context, key string) (int64, error) {
+	n, err := redis.Int64(r.do(ctx, "ZCARD", key))
+	return n, cmdError("ZCARD", key, err)
+}
+
+// ZRank returns the rank of member, lowest score first. A missing member is
+// reported as ErrCacheMiss.
+func (r *Redis) ZRank(ctx context.Context, key, member string) (int64, error) {
+	n, err := redis.Int64(r.do(ctx, "ZRANK", key, member))
+	return n, cmdError("ZRANK", key, err)
+}
+
+// ZRange returns the members ranked start to stop, lowest score first.
+func (r *Redis) ZRange(ctx context.Context, key string, start, stop int64) ([]string, error) {
+	vals, err := redis.Strings(r.do(ctx, "ZRANGE", key, start, stop))
+	return vals, cmdError("ZRANGE", key, err)
+}
+
+func (r *Redis) ZRangeWithScores(ctx context.Context, key string, start, stop int64) ([]Z, error) {
+	zs, err := scanZ(r.do(ctx, "ZRANGE", key, start, stop, "WITHSCORES"))
+	return zs, cmdError("ZRANGE", key, err)
+}
+
+// ZRangeByScore returns members with scores between min and max, which use
+// the Redis syntax ("-inf", "(1.5", "10"). A count of zero or less returns
+// every match.
+func (r *Redis) ZRangeByScore(ctx context.Context, key, min, max string, offset, count int64) ([]Z, error) {
+	args := redis.Args{key, min, max, "WITHSCORES"}
+	if count > 0 {
+		args = args.Add("LIMIT", offset, count)
+	}
+	zs, err := scanZ(r.do(ctx, "ZRANGEBYSCORE", args...))
+	return zs, cmdError("ZRANGEBYSCORE", key, err)
+}
+
+func scanZ(reply interface{}, err error) ([]Z, error) {
+	vals, err := redis.Strings(reply, err)
+	if err != nil {
+		return nil, err
+	}
+	zs := make([]Z, 0, len(vals)/2)
+	for i := 0; i+1 < len(vals); i += 2 {
+		score, err := strconv.ParseFloat(vals[i+1], 64)
+		if err != nil {
+			return nil, err
+		}
+		zs = append(zs, Z{Member: vals[i], Score: score})
+	}
+	return zs, nil
+}
+
+// Scanning
+
+// ScanIterator walks the results of SCAN, SSCAN, HSCAN or ZSCAN page by
+// page:
+//
+//	it := r.Scan("user:*", 100)
+//	for it.Next(ctx) {
+//		key := it.Val()
+//	}
+//	if err := it.Err(); err != nil { ... }
+//
+// HScan and ZScan return fields and values (or members and scores)
+// alternately. In cluster mode Scan walks every master in turn, each with
+// its own cursor.
+type ScanIterator struct {
+	r      *Redis
+	nodes  []string
+	cmd    string
+	key    string
+	match  string
+	count  int
+	cursor string
+	page   []string
+	val    string
+	done   bool
+	err    error
+}
+
+// Scan iterates over the keys matching the glob pattern match, all keys if it
+// is empty. count is a hint for the page size.
+func (r *Redis) Scan(match string, count int) *ScanIterator {
+	return &ScanIterator{r: r, cmd: "SCAN", match: match, count: count, cursor: "0"}
+}
+
+func (r *Redis) SScan(key, match string, count int) *ScanIterator {
+	return &ScanIterator{r: r, cmd: "SSCAN", key: key, match: match, count: count, cursor: "0"}
+}
+
+func (r *Redis) HScan(key, match string, count int) *ScanIterator {
+	return &ScanIterator{r: r, cmd: "HSCAN", key: key, match: match, count: count, cursor: "0"}
+}
+
+func (r *Redis) ZScan(key, match string, count int) *ScanIterator {
+	return &ScanIterator{r: r, cmd: "ZSCAN", key: key, match: match, count: count, cursor: "0"}
+}
+
+// Next advances to the next element, fetching pages as needed. It returns
+// false when the iteration is complete or failed.
+func (it *ScanIterator) Next(ctx context.Context) bool {
+	for len(it.page) == 0 {
+		if it.done || it.err != nil {
+			return false
+		}
+		it.fetch(ctx)
+	}
+	it.val, it.page = it.page[0], it.page[1:]
+	return true
+}
+
+func (it *ScanIterator) fetch(ctx context.Context) {
+	args := redis.Args{}
+	if it.key != "" {
+		args = args.Add(it.key)
+	}
+	args = args.Add(it.cursor)
+	if it.match != "" {
+		args = args.Add("MATCH", it.match)
+	}
+	if it.count > 0 {
+		args = args.Add("COUNT", it.count)
+	}
+
+	vals, err := redis.Values(it.do(ctx, args))
+	if err == nil && len(vals) != 2 {
+		err = fmt.Errorf("unexpected %s reply", it.cmd)
+	}
+	if err != nil {
+		it.err = cmdError(it.cmd, it.key, err)
+		return
+	}
+	if it.cursor, err = redis.String(vals[0], nil); err != nil {
+		it.err = cmdError(it.cmd, it.key, err)
+		return
+	}
+	if it.page, err = redis.Strings(vals[1], nil); err != nil {
+		it.err = cmdError(it.cmd, it.key, err)
+		return
+	}
+	if it.cursor == "0" && len(it.nodes) > 0 {
+		it.nodes = it.nodes[1:]
+		it.done = len(it.nodes) == 0
+		return
+	}
+	it.done = it.cursor == "0"
+}
+
+// do sends one page request. SCAN cursors only mean something to the node
+// that returned them, so in cluster mode every page of a node goes to it.
+func (it *ScanIterator) do(ctx context.Context, args redis.Args) (interface{}, error) {
+	if it.cmd != "SCAN" || it.r.cluster == nil {
+		return it.r.do(ctx, it.cmd, args...)
+	}
+	if it.nodes == nil {
+		masters, err := it.r.cluster.loadedMasters()
+		if err != nil {
+			return nil, err
+		}
+		if len(masters) == 0 {
+			return nil, fmt.Errorf("cluster has no nodes serving slots")
+		}
+		it.nodes = masters
+	}
+	timeout, err := ctxTimeout(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return it.r.cluster.doOn(it.nodes[0], false, timeout, it.cmd, args...)
+}
+
+// Val returns the current element.
+func (it *ScanIterator) Val() string {
+	return it.val
+}
+
+// Err returns the error that stopped the iteration, if any.
+func (it *ScanIterator) Err() error {
+	return it.err
+}
@@ -0,0 +1,274 @@
+package db
+
+import (
+	"context"
+	"github.com/garyburd/redigo/redis"
+	"github.com/pkg/errors"
+)
+
+// ErrTxConflict is returned by Tx when a watched key kept changing and every
+// attempt was aborted.
+var ErrTxConflict = errors.New("redis transaction aborted: watched key changed")
+
+// TxMaxAttempts is how often Tx runs its function before giving up with
+// ErrTxConflict.
+const TxMaxAttempts = 10
+
+// Reply is the result of a command queued on a Pipeline or Tx. It is filled
+// in once the pipeline or transaction has been executed.
+type Reply struct {
+	cmd  string
+	key  string
+	args []interface{}
+	val  interface{}
+	err  error
+	done bool
+}
+
+func newReply(cmd string, args []interface{}) *Reply {
+	rp := &Reply{cmd: cmd, args: args}
+	if key, ok := commandKey(cmd, args); ok {
+		rp.key = key
+	}
+	return rp
+}
+
+func (rp *Reply) set(val interface{}, err error) {
+	if e, ok := val.(redis.Error); ok && err == nil {
+		val, err = nil, e
+	}
+	rp.val, rp.err, rp.done = val, err, true
+}
+
+func (rp *Reply) result() (interface{}, error) {
+	if !rp.done {
+		return nil, cmdError(rp.cmd, rp.key, errors.New("reply read before the commands were executed"))
+	}
+	return rp.val, rp.err
+}
+
+// Err returns the error of the command, if any.
+func (rp *Reply) Err() error {
+	_, err := rp.result()
+	return cmdError(rp.cmd, rp.key, err)
+}
+
+// Value returns the raw reply.
+func (rp *Reply) Value() (interface{}, error) {
+	v, err := rp.result()
+	return v, cmdError(rp.cmd, rp.key, err)
+}
+
+func (rp *Reply) Bytes() ([]byte, error) {
+	b, err := redis.Bytes(rp.result())
+	return b, cmdError(rp.cmd, rp.key, err)
+}
+
+func (rp *Reply) Text() (string, error) {
+	s, err := redis.String(rp.result())
+	return s, cmdError(rp.cmd, rp.key, err)
+}
+
+func (rp *Reply) Int64() (int64, error) {
+	n, err := redis.Int64(rp.result())
+	return n, cmdError(rp.cmd, rp.key, err)
+}
+
+func (rp *Reply) Bool() (bool, error) {
+	ok, err := redis.Bool(rp.result())
+	return ok, cmdError(rp.cmd, rp.key, err)
+}
+
+func (rp *Reply) Float64() (float64, error) {
+	f, err := redis.Float64(rp.result())
+	return f, cmdError(rp.cmd, rp.key, err)
+}
+
+func (rp *Reply) Strings() ([]string, error) {
+	s, err := redis.Strings(rp.result())
+	return s, cmdError(rp.cmd, rp.key, err)
+}
+
+// Pipeline queues commands and sends them to Redis in one round trip:
+//
+//	p := r.Pipeline()
+//	a := p.Do("INCR", "a")
+//	b := p.Do("GET", "b")
+//	if err := p.Exec(ctx); err != nil { ... }
+//	n, _ := a.Int64()
+//
+// In cluster mode the commands are still routed by key, one by one.
+type Pipeline struct {
+	r       *Redis
+	replies []*Reply
+}
+
+func (r *Redis) Pipeline() *Pipeline {
+	return &Pipeline{r: r}
+}
+
+// Do queues a command and returns its future reply.
+func (p *Pipeline) Do(cmd string, args ...interface{}) *Reply {
+	rp := newReply(cmd, args)
+	p.replies = append(p.replies, rp)
+	return rp
+}
+
+func (p *Pipeline) Len() int {
+	return len(p.replies)
+}
+
+// Exec sends every queued command and reads the replies. It returns the first
+// error, but every reply is filled in either way. The pipeline is empty
+// afterwards and can be reused.
+func (p *Pipeline) Exec(ctx context.Context) error {
+	replies := p.replies
+	p.replies = nil
+	if len(replies) == 0 {
+		return nil
+	}
+
+	conn, err := p.r.DB.GetContext(ctx)
+	if err != nil {
+		return failReplies(replies, err)
+	}
+	defer conn.Close()
+	timeout, err := ctxTimeout(ctx)
+	if err != nil {
+		return failReplies(replies, err)
+	}
+
+	for _, rp := range replies {
+		if err := conn.Send(rp.cmd, rp.args...); err != nil {
+			return failReplies(replies, err)
+		}
+	}
+	if err := conn.Flush(); err != nil {
+		return failReplies(replies, err)
+	}
+
+	var first error
+	for i, rp := range replies {
+		v, err := redis.ReceiveWithTimeout(conn, timeout)
+		if _, ok := err.(redis.Error); err != nil && !ok {
+			// the connection is broken, the remaining replies are lost
+			return failReplies(replies[i:], err)
+		}
+		rp.set(v, err)
+		if first == nil && rp.err != nil {
+			first = cmdError(rp.cmd, rp.key, rp.err)
+		}
+	}
+	return first
+}
+
+func failReplies(replies []*Reply, err error) error {
+	for _, rp := range replies {
+		rp.set(nil, err)
+	}
+	return cmdError(replies[0].cmd, replies[0].key, err)
+}
+
+// Tx is handed to the function run by Redis.Tx. Do runs commands right away
+// on the connection holding the WATCH, Queue adds commands to the MULTI/EXEC
+// block sent once the function returns.
+type Tx struct {
+	conn    redis.Conn
+	ctx     context.Context
+	replies []*Reply
+}
+
+// Do runs a command immediately, typically to read watched keys.
+func (tx *Tx) Do(cmd string, args ...interface{}) (interface{}, error) {
+	timeout, err := ctxTimeout(tx.ctx)
+	if err != nil {
+		return nil, err
+	}
+	v, err := redis.DoWithTimeout(tx.conn, timeout, cmd, args...)
+	key, _ := commandKey(cmd, args)
+	return v, cmdError(cmd, key, err)
+}
+
+// Queue adds a command to the transaction and returns its future reply.
+func (tx *Tx) Queue(cmd string, args ...interface{}) *Reply {
+	rp := newReply(cmd, args)
+	tx.replies = append(tx.replies, rp)
+	return rp
+}
+
+// Tx runs fn in an optimistic transaction. watchKeys are WATCHed before fn
+// runs; the commands fn queues are sent in MULTI/EXEC afterwards. If a watched
+// key changed in the meantime, EXEC is aborted and fn runs again after a
+// short backoff, up to TxMaxAttempts times. If fn returns an error nothing
+// is sent.
+//
+// In cluster mode every key must hash to the same slot.
+func (r *Redis) Tx(ctx context.Context, watchKeys []string, fn func(tx *Tx) error) error {
+	for attempt := 1; attempt <= TxMaxAttempts; attempt++ {
+		ok, err := r.tryTx(ctx, watchKeys, fn)
+		if err != nil || ok {
+			return err
+		}
+		if attempt < TxMaxAttempts {
+			if err := sleepContext(ctx, txRetryPolicy.Backoff(attempt)); err != nil {
+				return err
+			}
+		}
+	}
+	return ErrTxConflict
+}
+
+// tryTx reports false if EXEC was aborted by a watched key change.
+func (r *Redis) tryTx(ctx context.Context, watchKeys []string, fn func(tx *Tx) error) (bool, error) {
+	conn, err := r.DB.GetContext(ctx)
+	if err != nil {
+		return false, cmdError("MULTI", "", err)
+	}
+	defer conn.Close()
+
+	tx := &Tx{conn: conn, ctx: ctx}
+	if len(watchKeys) > 0 {
+		if _, err := tx.Do("WATCH", redis.Args{}.AddFlat(watchKeys)...); err != nil {
+			return false, err
+		}
+	}
+	if err := fn(tx); err != nil {
+		conn.Do("UNWATCH")
+		return false, err
+	}
+	if len(tx.replies) == 0 {
+		_, err := tx.Do("UNWATCH")
+		return true, err
+	}
+
+	timeout, err := ctxTimeout(ctx)
+	if err != nil {
+		conn.Do("UNWATCH")
+		return false, err
+	}
+	if err := conn.Send("MULTI"); err != nil {
+		return false, cmdError("MULTI", "", err)
+	}
+	for _, rp := range tx.replies {
+		if err := conn.Send(rp.cmd, rp.args...); err != nil {
+			return false, cmdError(rp.cmd, rp.key, err)
+		}
+	}
+	res, err := redis.DoWithTimeout(conn, timeout, "EXEC")
+	if err != nil {
+		return false, cmdError("EXEC", "", err)
+	}
+	if res == nil {
+		return false, nil
+	}
+	vals, err := redis.Values(res, nil)
+	if err != nil {
+		return false, cmdError("EXEC", "", err)
+	}
+	for i, rp := range tx.replies {
+		if i < len(vals) {
+			rp.set(vals[i], nil)
+		}
+	}
+	return true, nil
+}
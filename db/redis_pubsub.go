@@ -0,0 +1,217 @@
+package db
+
+import (
+	"context"
+	"github.com/garyburd/redigo/redis"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"sync"
+	"time"
+)
+
+const (
+	// pubSubPingInterval is how often an idle subscription pings the server,
+	// and twice that is how long it waits for anything before reconnecting.
+	pubSubPingInterval = 30 * time.Second
+	pubSubBuffer       = 100
+)
+
+// Publish posts data to channel and returns the number of subscribers that
+// received it.
+func (r *Redis) Publish(ctx context.Context, channel string, data interface{}) (int64, error) {
+	n, err := redis.Int64(r.do(ctx, "PUBLISH", channel, data))
+	return n, cmdError("PUBLISH", channel, err)
+}
+
+// Message is a message received on a Subscription. Pattern is set for
+// messages matched by PSubscribe.
+type Message struct {
+	Channel string
+	Pattern string
+	Data    []byte
+}
+
+// Subscription delivers messages from a dedicated connection. If the
+// connection drops it reconnects and subscribes again, backing off as
+// configured by DBOpts.Retry; messages published in between are lost.
+type Subscription struct {
+	r        *Redis
+	patterns bool
+	names    []string
+	ch       chan *Message
+	resub    chan struct{}
+	cancel   context.CancelFunc
+	done     chan struct{}
+
+	mu   sync.Mutex
+	conn redis.Conn
+}
+
+// Subscribe listens on channels until ctx is done, the subscription is
+// closed or Redis is closed. It returns once the first subscription is confirmed.
+func (r *Redis) Subscribe(ctx context.Context, channels ...string) (*Subscription, error) {
+	return r.subscribe(ctx, false, channels)
+}
+
+// PSubscribe listens on every channel matching the glob patterns.
+func (r *Redis) PSubscribe(ctx context.Context, patterns ...string) (*Subscription, error) {
+	return r.subscribe(ctx, true, patterns)
+}
+
+func (r *Redis) subscribe(ctx context.Context, patterns bool, names []string) (*Subscription, error) {
+	if len(names) == 0 {
+		return nil, errors.New("nothing to subscribe to")
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	s := &Subscription{
+		r:        r,
+		patterns: patterns,
+		names:    names,
+		ch:       make(chan *Message, pubSubBuffer),
+		resub:    make(chan struct{}, 1),
+		cancel:   cancel,
+		done:     make(chan struct{}),
+	}
+	psc, err := s.connect()
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	go s.run(ctx, psc)
+	return s, nil
+}
+
+// C returns the channel messages are delivered on. It is closed when the
+// subscription ends.
+func (s *Subscription) C() <-chan *Message {
+	return s.ch
+}
+
+// Reconnected receives a value after the subscription was lost and made
+// again. Messages published in between were missed.
+func (s *Subscription) Reconnected() <-chan struct{} {
+	return s.resub
+}
+
+// Close ends the subscription and waits for its connection to be closed.
+func (s *Subscription) Close() error {
+	s.cancel()
+	s.closeConn()
+	<-s.done
+	return nil
+}
+
+func (s *Subscription) closeConn() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conn != nil {
+		s.r.releaseConn(s.conn)
+		s.conn = nil
+	}
+}
+
+// connect dials a new connection and waits until every name is subscribed.
+func (s *Subscription) connect() (*redis.PubSubConn, error) {
+	c, err := s.r.holdConn("")
+	if err != nil {
+		return nil, err
+	}
+	psc := &redis.PubSubConn{Conn: c}
+	args := redis.Args{}.AddFlat(s.names)
+	if s.patterns {
+		err = psc.PSubscribe(args...)
+	} else {
+		err = psc.Subscribe(args...)
+	}
+	for confirmed := 0; err == nil && confirmed < len(s.names); {
+		switch v := psc.ReceiveWithTimeout(2 * pubSubPingInterval).(type) {
+		case redis.Subscription:
+			confirmed++
+		case error:
+			err = v
+		}
+	}
+	if err != nil {
+		s.r.releaseConn(c)
+		return nil, errors.Wrap(err, "Redis subscription failed")
+	}
+
+	s.mu.Lock()
+	s.conn = c
+	s.mu.Unlock()
+	return psc, nil
+}
+
+func (s *Subscription) run(ctx context.Context, psc *redis.PubSubConn) {
+	defer close(s.done)
+	defer close(s.ch)
+	defer s.cancel()
+	go func() {
+		// unblock Receive when the subscription ends
+		<-ctx.Done()
+		s.closeConn()
+	}()
+
+	policy := s.r.Opt.retryPolicy()
+	for {
+		err := s.receive(ctx, psc)
+		s.closeConn()
+		for attempt := 1; ctx.Err() == nil && !s.r.closing.Load(); attempt++ {
+			logrus.WithError(err).WithField("attempt", attempt).Warn("Redis subscription lost, reconnecting")
+			if sleepContext(ctx, policy.Backoff(attempt)) != nil {
+				break
+			}
+			if psc, err = s.connect(); err == nil {
+				break
+			}
+		}
+		if ctx.Err() != nil || s.r.closing.Load() {
+			// a connection made while closing is not seen by the watcher
+			s.closeConn()
+			return
+		}
+		select {
+		case s.resub <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// receive delivers messages until the connection fails.
+func (s *Subscription) receive(ctx context.Context, psc *redis.PubSubConn) error {
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		t := time.NewTicker(pubSubPingInterval)
+		defer t.Stop()
+		for {
+			select {
+			case <-t.C:
+				if psc.Ping("") != nil {
+					return
+				}
+			case <-stop:
+				return
+			}
+		}
+	}()
+
+	for {
+		var msg *Message
+		switch v := psc.ReceiveWithTimeout(2 * pubSubPingInterval).(type) {
+		case redis.Message:
+			msg = &Message{Channel: v.Channel, Data: v.Data}
+		case redis.PMessage:
+			msg = &Message{Channel: v.Channel, Pattern: v.Pattern, Data: v.Data}
+		case error:
+			return v
+		default:
+			continue
+		}
+		select {
+		case s.ch <- msg:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
@@ -0,0 +1,111 @@
+package db
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"github.com/garyburd/redigo/redis"
+	"github.com/pkg/errors"
+	"strings"
+)
+
+// Script is a Lua script run with EVALSHA. If the server does not know the
+// script yet it falls back to EVAL, which also caches it for the next call:
+//
+//	var compareAndDelete = db.NewScript(1, `
+//		if redis.call("GET", KEYS[1]) == ARGV[1] then
+//			return redis.call("DEL", KEYS[1])
+//		end
+//		return 0`)
+//
+//	n, err := redis.Int64(compareAndDelete.Run(ctx, r, []string{"lock"}, token))
+//
+// Scripts registered with Redis.RegisterScript are loaded on Connect.
+type Script struct {
+	keyCount int
+	src      string
+	hash     string
+}
+
+// NewScript returns a script taking keyCount keys. The keys are passed to Run
+// separately from the other arguments.
+func NewScript(keyCount int, src string) *Script {
+	h := sha1.Sum([]byte(src))
+	return &Script{keyCount: keyCount, src: src, hash: hex.EncodeToString(h[:])}
+}
+
+// Hash returns the SHA1 digest EVALSHA knows the script by.
+func (s *Script) Hash() string {
+	return s.hash
+}
+
+func (s *Script) args(spec string, keys []string, args []interface{}) (redis.Args, error) {
+	if len(keys) != s.keyCount {
+		return nil, errors.Errorf("script takes %d keys, got %d", s.keyCount, len(keys))
+	}
+	return redis.Args{spec, len(keys)}.AddFlat(keys).Add(args...), nil
+}
+
+// Run evaluates the script with EVALSHA, or EVAL if the server replies
+// NOSCRIPT, and returns the raw reply. Use the redigo helpers such as
+// redis.Int64 to convert it.
+func (s *Script) Run(ctx context.Context, r *Redis, keys []string, args ...interface{}) (interface{}, error) {
+	var key string
+	if len(keys) > 0 {
+		key = keys[0]
+	}
+	evalArgs, err := s.args(s.hash, keys, args)
+	if err != nil {
+		return nil, cmdError("EVALSHA", key, err)
+	}
+	reply, err := r.do(ctx, "EVALSHA", evalArgs...)
+	if e, ok := err.(redis.Error); ok && strings.HasPrefix(string(e), "NOSCRIPT") {
+		evalArgs[0] = s.src
+		reply, err = r.do(ctx, "EVAL", evalArgs...)
+		if err != nil {
+			return nil, cmdError("EVAL", key, err)
+		}
+		return reply, nil
+	}
+	if err != nil {
+		return nil, cmdError("EVALSHA", key, err)
+	}
+	return reply, nil
+}
+
+// Load caches the script on the server with SCRIPT LOAD. In cluster mode it is
+// loaded on every master.
+func (s *Script) Load(ctx context.Context, r *Redis) error {
+	_, err := r.do(ctx, "SCRIPT", "LOAD", s.src)
+	return cmdError("SCRIPT LOAD", "", err)
+}
+
+// RegisterScript adds scripts to be loaded whenever r connects. If r is
+// already connected they are loaded right away.
+func (r *Redis) RegisterScript(ctx context.Context, scripts ...*Script) error {
+	r.scriptsMu.Lock()
+	r.scripts = append(r.scripts, scripts...)
+	r.scriptsMu.Unlock()
+	if r.DB == nil {
+		return nil
+	}
+	return loadScripts(ctx, r, scripts)
+}
+
+// loadScripts loads the registered scripts after Connect. A script that does
+// not compile makes Connect fail rather than every later Run.
+func (r *Redis) loadScripts(ctx context.Context) error {
+	r.scriptsMu.Lock()
+	scripts := append([]*Script(nil), r.scripts...)
+	r.scriptsMu.Unlock()
+	return loadScripts(ctx, r, scripts)
+}
+
+func loadScripts(ctx context.Context, r *Redis, scripts []*Script) error {
+	for _, s := range scripts {
+		if err := s.Load(ctx, r); err != nil {
+			return errors.Wrap(err, "Redis script can not be loaded")
+		}
+	}
+	return nil
+}
@@ -0,0 +1,86 @@
+package db
+
+import (
+	"fmt"
+	"github.com/garyburd/redigo/redis"
+	"github.com/pkg/errors"
+	"net"
+	"strings"
+	"sync"
+)
+
+// redisSentinel asks a list of Sentinels for the current master address.
+type redisSentinel struct {
+	masterName string
+	dialOpts   []redis.DialOption
+
+	mu    sync.Mutex
+	addrs []string
+}
+
+func newRedisSentinel(masterName string, addrs []string, dialOpts []redis.DialOption) *redisSentinel {
+	return &redisSentinel{
+		masterName: masterName,
+		dialOpts:   dialOpts,
+		addrs:      append([]string(nil), addrs...),
+	}
+}
+
+// masterAddr queries the Sentinels in turn and returns the first answer. The
+// Sentinel that answered is moved to the front so it is asked first next time.
+func (s *redisSentinel) masterAddr() (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var errs []string
+	for i, addr := range s.addrs {
+		master, err := s.query(addr)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %v", addr, err))
+			continue
+		}
+		copy(s.addrs[1:i+1], s.addrs[:i])
+		s.addrs[0] = addr
+		return master, nil
+	}
+	return "", fmt.Errorf("no sentinel knows master %q (%s)", s.masterName, strings.Join(errs, "; "))
+}
+
+func (s *redisSentinel) query(addr string) (string, error) {
+	c, err := redis.Dial("tcp", addr, s.dialOpts...)
+	if err != nil {
+		return "", err
+	}
+	defer c.Close()
+
+	res, err := redis.Strings(c.Do("SENTINEL", "get-master-addr-by-name", s.masterName))
+	if err == redis.ErrNil {
+		return "", errors.New("unknown master")
+	}
+	if err != nil {
+		return "", err
+	}
+	if len(res) != 2 {
+		return "", fmt.Errorf("unexpected sentinel reply %q", res)
+	}
+	return net.JoinHostPort(res[0], res[1]), nil
+}
+
+// checkRole fails unless the server behind c reports the given ROLE.
+func checkRole(c redis.Conn, want string) error {
+	res, err := redis.Values(c.Do("ROLE"))
+	if err != nil {
+		return err
+	}
+	if len(res) == 0 {
+		return errors.New("empty ROLE reply")
+	}
+	role, err := redis.String(res[0], nil)
+	if err != nil {
+		return err
+	}
+	if role != want {
+		return fmt.Errorf("server is a %s, not a %s", role, want)
+	}
+	return nil
+}
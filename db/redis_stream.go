@@ -0,0 +1,341 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"github.com/garyburd/redigo/redis"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"runtime/debug"
+	"strings"
+	"sync"
+	"time"
+)
+
+// XMessage is a stream entry.
+type XMessage struct {
+	ID     string
+	Values map[string]string
+}
+
+// XPendingEntry is an entry delivered to a consumer but not acknowledged.
+type XPendingEntry struct {
+	ID         string
+	Consumer   string
+	Idle       time.Duration
+	Deliveries int64
+}
+
+// XAdd appends an entry to stream and returns its ID. With maxLen above zero
+// the stream is trimmed to about that many entries.
+func (r *Redis) XAdd(ctx context.Context, stream string, maxLen int64, values map[string]interface{}) (string, error) {
+	args := redis.Args{stream}
+	if maxLen > 0 {
+		args = args.Add("MAXLEN", "~", maxLen)
+	}
+	args = args.Add("*").AddFlat(values)
+	id, err := redis.String(r.do(ctx, "XADD", args...))
+	return id, cmdError("XADD", stream, err)
+}
+
+// XGroupCreate creates a consumer group reading stream from start ("$" for
+// new entries only, "0" for the whole stream), creating the stream if needed.
+// An existing group is not an error.
+func (r *Redis) XGroupCreate(ctx context.Context, stream, group, start string) error {
+	_, err := r.do(ctx, "XGROUP", "CREATE", stream, group, start, "MKSTREAM")
+	if e, ok := err.(redis.Error); ok && strings.HasPrefix(string(e), "BUSYGROUP") {
+		return nil
+	}
+	return cmdError("XGROUP", stream, err)
+}
+
+// XReadGroup reads up to count entries never delivered to group, waiting up
+// to block for new ones. A block of zero or less does not wait. It returns
+// no entries and no error if nothing arrived in time.
+func (r *Redis) XReadGroup(ctx context.Context, stream, group, consumer string, count int, block time.Duration) ([]XMessage, error) {
+	reply, err := r.do(ctx, "XREADGROUP", xReadGroupArgs(stream, group, consumer, count, block)...)
+	return parseXReadGroup(stream, reply, err)
+}
+
+// xReadGroup is XReadGroup on conn, a connection from holdConn, so a read
+// blocked in it ends when Redis is closed.
+func (r *Redis) xReadGroup(ctx context.Context, conn redis.Conn, stream, group, consumer string, count int, block time.Duration) ([]XMessage, error) {
+	timeout, err := ctxTimeout(ctx)
+	if err != nil {
+		return nil, err
+	}
+	reply, err := redis.DoWithTimeout(conn, timeout, "XREADGROUP", xReadGroupArgs(stream, group, consumer, count, block)...)
+	if r.cluster != nil {
+		r.cluster.redirected(err)
+	}
+	return parseXReadGroup(stream, reply, err)
+}
+
+func xReadGroupArgs(stream, group, consumer string, count int, block time.Duration) redis.Args {
+	args := redis.Args{"GROUP", group, consumer, "COUNT", count}
+	if block > 0 {
+		args = args.Add("BLOCK", Millis(block))
+	}
+	return args.Add("STREAMS", stream, ">")
+}
+
+func parseXReadGroup(stream string, reply interface{}, err error) ([]XMessage, error) {
+	if err != nil || reply == nil {
+		return nil, cmdError("XREADGROUP", stream, err)
+	}
+	streams, err := redis.Values(reply, nil)
+	if err != nil || len(streams) == 0 {
+		return nil, cmdError("XREADGROUP", stream, err)
+	}
+	// a single stream was read: [[name, entries]]
+	s, err := redis.Values(streams[0], nil)
+	if err != nil || len(s) != 2 {
+		return nil, cmdError("XREADGROUP", stream, fmt.Errorf("unexpected reply %v", streams[0]))
+	}
+	msgs, err := scanXMessages(s[1], nil)
+	return msgs, cmdError("XREADGROUP", stream, err)
+}
+
+// XAck acknowledges entries so they leave the pending list of group.
+func (r *Redis) XAck(ctx context.Context, stream, group string, ids ...string) (int64, error) {
+	n, err := redis.Int64(r.do(ctx, "XACK", redis.Args{stream, group}.AddFlat(ids)...))
+	return n, cmdError("XACK", stream, err)
+}
+
+// XPending lists up to count entries pending in group, oldest first.
+func (r *Redis) XPending(ctx context.Context, stream, group string, count int) ([]XPendingEntry, error) {
+	vals, err := redis.Values(r.do(ctx, "XPENDING", stream, group, "-", "+", count))
+	if err != nil {
+		return nil, cmdError("XPENDING", stream, err)
+	}
+	entries := make([]XPendingEntry, 0, len(vals))
+	for _, v := range vals {
+		var (
+			e    XPendingEntry
+			idle int64
+		)
+		fields, err := redis.Values(v, nil)
+		if err == nil {
+			_, err = redis.Scan(fields, &e.ID, &e.Consumer, &idle, &e.Deliveries)
+		}
+		if err != nil {
+			return nil, cmdError("XPENDING", stream, err)
+		}
+		e.Idle = time.Duration(idle) * time.Millisecond
+		entries = append(entries, e)
+	}
+	return entries, nil
+}
+
+// XClaim moves pending entries idle for at least minIdle to consumer and
+// returns them. Entries that were acknowledged or deleted meanwhile are left
+// out.
+func (r *Redis) XClaim(ctx context.Context, stream, group, consumer string, minIdle time.Duration, ids ...string) ([]XMessage, error) {
+	args := redis.Args{stream, group, consumer, Millis(minIdle)}.AddFlat(ids)
+	msgs, err := scanXMessages(r.do(ctx, "XCLAIM", args...))
+	return msgs, cmdError("XCLAIM", stream, err)
+}
+
+func scanXMessages(reply interface{}, err error) ([]XMessage, error) {
+	entries, err := redis.Values(reply, err)
+	if err != nil {
+		return nil, err
+	}
+	msgs := make([]XMessage, 0, len(entries))
+	for _, e := range entries {
+		fields, err := redis.Values(e, nil)
+		if err != nil || len(fields) != 2 {
+			// deleted entries are reported as nil
+			continue
+		}
+		id, err := redis.String(fields[0], nil)
+		if err != nil {
+			return nil, err
+		}
+		values, err := redis.StringMap(fields[1], nil)
+		if err != nil {
+			return nil, err
+		}
+		msgs = append(msgs, XMessage{ID: id, Values: values})
+	}
+	return msgs, nil
+}
+
+// StreamWorker consumes a stream as a member of a consumer group. Entries are
+// acknowledged once Handler returns nil; failed entries stay pending and are
+// retried when claimed after ClaimIdle, by this or any other worker.
+type StreamWorker struct {
+	Redis    *Redis
+	Stream   string
+	Group    string
+	Consumer string
+	Handler  func(ctx context.Context, msg XMessage) error
+
+	// Concurrency is the number of entries handled at once, 1 by default.
+	Concurrency int
+	// Block is how long a read waits for new entries, 5s by default.
+	Block time.Duration
+	// ClaimIdle is how long an entry stays pending before it is claimed
+	// again. Zero disables claiming.
+	ClaimIdle time.Duration
+}
+
+// Run creates the group if it does not exist and consumes the stream until
+// ctx is done. It then waits for running handlers and returns ctx.Err(). A
+// read already blocking is not interrupted, so stopping can take up to
+// Block. Handlers get a context that is not cancelled with ctx, so they can
+// finish their entry. Closing Redis interrupts the read and Run returns
+// ErrPoolClosing.
+//
+// Delivery is at least once: an entry whose handler fails or panics, or
+// whose worker dies, is handled again once another worker claims it.
+// Entries still being handled by this worker are never claimed by it.
+func (w *StreamWorker) Run(ctx context.Context) error {
+	if err := w.Redis.XGroupCreate(ctx, w.Stream, w.Group, "0"); err != nil {
+		return err
+	}
+	concurrency := w.Concurrency
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	block := w.Block
+	if block <= 0 {
+		block = 5 * time.Second
+	}
+
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	slots := make(chan struct{}, concurrency)
+	var mu sync.Mutex
+	running := make(map[string]bool)
+	handle := func(msg XMessage) {
+		defer func() {
+			if p := recover(); p != nil {
+				logrus.WithField("id", msg.ID).Errorf("stream %s handler panicked: %v\n%s", w.Stream, p, debug.Stack())
+			}
+			mu.Lock()
+			delete(running, msg.ID)
+			mu.Unlock()
+			<-slots
+			wg.Done()
+		}()
+		hctx := context.Background()
+		if err := w.Handler(hctx, msg); err != nil {
+			logrus.WithError(err).WithField("id", msg.ID).Warnf("stream %s entry failed", w.Stream)
+			return
+		}
+		if _, err := w.Redis.XAck(hctx, w.Stream, w.Group, msg.ID); err != nil {
+			logrus.WithError(err).WithField("id", msg.ID).Warnf("stream %s entry can not be acknowledged", w.Stream)
+		}
+	}
+
+	// the blocking reads use a connection of their own, so Redis.Close can
+	// interrupt them
+	var conn redis.Conn
+	defer func() {
+		if conn != nil {
+			w.Redis.releaseConn(conn)
+		}
+	}()
+
+	lastClaim := time.Now()
+	for attempt := 0; ; {
+		// wait for at least one free slot
+		select {
+		case slots <- struct{}{}:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		free := 1
+	fill:
+		for free < concurrency {
+			select {
+			case slots <- struct{}{}:
+				free++
+			default:
+				break fill
+			}
+		}
+
+		var (
+			msgs []XMessage
+			err  error
+		)
+		if w.ClaimIdle > 0 && time.Since(lastClaim) >= w.ClaimIdle {
+			lastClaim = time.Now()
+			mu.Lock()
+			skip := make(map[string]bool, len(running))
+			for id := range running {
+				skip[id] = true
+			}
+			mu.Unlock()
+			msgs, err = w.claim(ctx, free, skip)
+		}
+		if err == nil && len(msgs) == 0 {
+			if conn == nil {
+				conn, err = w.Redis.holdConn(w.Stream)
+			}
+			if err == nil {
+				if msgs, err = w.Redis.xReadGroup(ctx, conn, w.Stream, w.Group, w.Consumer, free, block); err != nil {
+					w.Redis.releaseConn(conn)
+					conn = nil
+				}
+			}
+		}
+		if err != nil {
+			for i := 0; i < free; i++ {
+				<-slots
+			}
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			if w.Redis.closing.Load() {
+				return ErrPoolClosing
+			}
+			attempt++
+			logrus.WithError(err).WithField("attempt", attempt).Warnf("stream %s can not be read", w.Stream)
+			if err := sleepContext(ctx, w.Redis.Opt.retryPolicy().Backoff(attempt)); err != nil {
+				return err
+			}
+			continue
+		}
+		attempt = 0
+
+		for i, msg := range msgs {
+			if i >= free {
+				break
+			}
+			mu.Lock()
+			running[msg.ID] = true
+			mu.Unlock()
+			wg.Add(1)
+			go handle(msg)
+		}
+		for i := len(msgs); i < free; i++ {
+			<-slots
+		}
+	}
+}
+
+// claim takes over up to count entries pending for longer than ClaimIdle,
+// leaving out the ones in skip.
+func (w *StreamWorker) claim(ctx context.Context, count int, skip map[string]bool) ([]XMessage, error) {
+	pending, err := w.Redis.XPending(ctx, w.Stream, w.Group, count+len(skip))
+	if err != nil {
+		return nil, err
+	}
+	var ids []string
+	for _, p := range pending {
+		if p.Idle >= w.ClaimIdle && !skip[p.ID] && len(ids) < count {
+			ids = append(ids, p.ID)
+		}
+	}
+	if len(ids) == 0 {
+		return nil, nil
+	}
+	msgs, err := w.Redis.XClaim(ctx, w.Stream, w.Group, w.Consumer, w.ClaimIdle, ids...)
+	if err != nil {
+		return nil, errors.Wrap(err, "pending entries can not be claimed")
+	}
+	return msgs, nil
+}
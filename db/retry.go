@@ -0,0 +1,111 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"math"
+	"math/rand"
+	"time"
+)
+
+// RetryPolicy controls how often and how fast a driver retries connecting.
+// The wait before attempt n+1 is InitialBackoff*Multiplier^(n-1), capped at
+// MaxBackoff and then spread by +/- Jitter (a fraction of the wait).
+type RetryPolicy struct {
+	MaxAttempts    int
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	Multiplier     float64
+	Jitter         float64
+}
+
+// DefaultRetryPolicy is used by every driver when DBOpts.Retry is nil.
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts:    6,
+	InitialBackoff: time.Second,
+	MaxBackoff:     16 * time.Second,
+	Multiplier:     2,
+	Jitter:         0.2,
+}
+
+// txRetryPolicy spaces out the attempts of a transaction that failed on a
+// conflict.
+var txRetryPolicy = RetryPolicy{
+	InitialBackoff: 10 * time.Millisecond,
+	MaxBackoff:     time.Second,
+	Multiplier:     2,
+	Jitter:         0.5,
+}
+
+// ConnectError is returned by Connect when every attempt failed. Err holds
+// the last failure, or the context error if connecting was cancelled.
+type ConnectError struct {
+	Driver   string
+	Attempts int
+	Err      error
+}
+
+func (e *ConnectError) Error() string {
+	return fmt.Sprintf("%s can not be connected after %d attempt(s): %v", e.Driver, e.Attempts, e.Err)
+}
+
+func (e *ConnectError) Cause() error { return e.Err }
+
+func (e *ConnectError) Unwrap() error { return e.Err }
+
+// Backoff returns the wait after the given failed attempt, starting at 1.
+func (p *RetryPolicy) Backoff(attempt int) time.Duration {
+	mult := p.Multiplier
+	if mult <= 0 {
+		mult = 2
+	}
+	d := float64(p.InitialBackoff) * math.Pow(mult, float64(attempt-1))
+	if p.MaxBackoff > 0 && d > float64(p.MaxBackoff) {
+		d = float64(p.MaxBackoff)
+	}
+	if p.Jitter > 0 {
+		d += d * p.Jitter * (2*rand.Float64() - 1)
+	}
+	if d < 0 {
+		return 0
+	}
+	return time.Duration(d)
+}
+
+func (p *RetryPolicy) attempts() int {
+	if p.MaxAttempts < 1 {
+		return 1
+	}
+	return p.MaxAttempts
+}
+
+// retry calls fn until it succeeds, the attempts run out or ctx is done.
+func (p *RetryPolicy) retry(ctx context.Context, driver string, fn func(ctx context.Context) error) error {
+	var err error
+	max := p.attempts()
+	for i := 1; i <= max; i++ {
+		if err = fn(ctx); err == nil {
+			return nil
+		}
+		if ctx.Err() != nil {
+			return &ConnectError{Driver: driver, Attempts: i, Err: errors.Wrap(ctx.Err(), err.Error())}
+		}
+		logrus.WithError(err).WithField("attempt", i).Warnf("%s not yet pinging", driver)
+		if i < max {
+			// don't sleep on the last failure
+			if serr := sleepContext(ctx, p.Backoff(i)); serr != nil {
+				return &ConnectError{Driver: driver, Attempts: i, Err: errors.Wrap(serr, err.Error())}
+			}
+		}
+	}
+	return &ConnectError{Driver: driver, Attempts: max, Err: err}
+}
+
+func (o *DBOpts) retryPolicy() *RetryPolicy {
+	if o.Retry != nil {
+		return o.Retry
+	}
+	return &DefaultRetryPolicy
+}
@@ -0,0 +1,98 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	mysqldrv "github.com/go-sql-driver/mysql"
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"strconv"
+	"sync/atomic"
+)
+
+// SQLTxMaxAttempts is how often WithTx runs its function while the database
+// keeps aborting the transaction with a serialization failure or deadlock.
+const SQLTxMaxAttempts = 5
+
+// WithTx runs fn in a transaction and commits it, or rolls it back if fn
+// returns an error or panics. On a serialization failure (40001) or deadlock
+// (40P01) the whole transaction runs again after a short backoff, so fn must
+// not have effects outside of tx. opts may be nil.
+func (p *PostgresDB) WithTx(ctx context.Context, opts *sql.TxOptions, fn func(tx *sqlx.Tx) error) error {
+	return withTx(ctx, p.DB, opts, "Postgres", postgresRetryable, fn)
+}
+
+// WithTx is PostgresDB.WithTx for MySQL, retrying on deadlocks (1213) and
+// lock wait timeouts (1205).
+func (m *MysqlDB) WithTx(ctx context.Context, opts *sql.TxOptions, fn func(tx *sqlx.Tx) error) error {
+	return withTx(ctx, m.DB, opts, "Mysql", mysqlRetryable, fn)
+}
+
+func postgresRetryable(err error) bool {
+	var pe *pq.Error
+	return errors.As(err, &pe) && (pe.Code == "40001" || pe.Code == "40P01")
+}
+
+func mysqlRetryable(err error) bool {
+	var me *mysqldrv.MySQLError
+	return errors.As(err, &me) && (me.Number == 1213 || me.Number == 1205)
+}
+
+func withTx(ctx context.Context, db *sqlx.DB, opts *sql.TxOptions, driver string, retryable func(error) bool, fn func(tx *sqlx.Tx) error) error {
+	for attempt := 1; ; attempt++ {
+		err := runTx(ctx, db, opts, fn)
+		if err == nil || !retryable(err) || attempt >= SQLTxMaxAttempts {
+			return err
+		}
+		logrus.WithError(err).WithField("attempt", attempt).Debugf("%s transaction aborted, retrying", driver)
+		if sleepContext(ctx, txRetryPolicy.Backoff(attempt)) != nil {
+			return err
+		}
+	}
+}
+
+func runTx(ctx context.Context, db *sqlx.DB, opts *sql.TxOptions, fn func(tx *sqlx.Tx) error) error {
+	tx, err := db.BeginTxx(ctx, opts)
+	if err != nil {
+		return errors.Wrap(err, "error beginning transaction")
+	}
+	defer func() {
+		if p := recover(); p != nil {
+			tx.Rollback()
+			panic(p)
+		}
+	}()
+	if err := fn(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return errors.Wrap(err, "error committing transaction")
+	}
+	return nil
+}
+
+var savepointSeq uint64
+
+// Savepoint runs fn inside a savepoint of tx, so an error from fn undoes
+// only what fn did and tx can go on. Savepoints nest. The error is still
+// returned; a serialization failure or deadlock returned on to WithTx
+// retries the whole transaction.
+func Savepoint(ctx context.Context, tx *sqlx.Tx, fn func(tx *sqlx.Tx) error) error {
+	name := "sp_" + strconv.FormatUint(atomic.AddUint64(&savepointSeq, 1), 10)
+	if _, err := tx.ExecContext(ctx, "SAVEPOINT "+name); err != nil {
+		return errors.Wrap(err, "error creating savepoint")
+	}
+	if err := fn(tx); err != nil {
+		if _, rerr := tx.ExecContext(ctx, "ROLLBACK TO SAVEPOINT "+name); rerr != nil {
+			logrus.WithError(rerr).Warnf("rollback to savepoint %s failed", name)
+		}
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, "RELEASE SAVEPOINT "+name); err != nil {
+		return errors.Wrap(err, "error releasing savepoint")
+	}
+	return nil
+}
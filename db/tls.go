@@ -0,0 +1,140 @@
+package db
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"github.com/pkg/errors"
+	"io/ioutil"
+)
+
+// TLSVerifyMode selects how much of the server certificate is checked.
+type TLSVerifyMode string
+
+const (
+	// TLSVerifyFull checks the certificate chain and the host name. It is
+	// used when Verify is empty.
+	TLSVerifyFull TLSVerifyMode = "full"
+	// TLSVerifyCA checks the certificate chain but not the host name.
+	TLSVerifyCA TLSVerifyMode = "ca"
+	// TLSSkipVerify encrypts the connection without checking the server.
+	TLSSkipVerify TLSVerifyMode = "skip"
+)
+
+// TLSOpts enables TLS for a connection. A zero TLSOpts verifies the server
+// against the system roots.
+type TLSOpts struct {
+	// CAFile is a PEM bundle used instead of the system roots.
+	CAFile string
+	// CertFile and KeyFile hold a PEM client certificate and key.
+	CertFile string
+	KeyFile  string
+	// ServerName overrides the host name checked against the certificate.
+	ServerName string
+	Verify     TLSVerifyMode
+}
+
+func (t *TLSOpts) verifyMode() TLSVerifyMode {
+	if t.Verify == "" {
+		return TLSVerifyFull
+	}
+	return t.Verify
+}
+
+// Validate reports option combinations no driver can use.
+func (t *TLSOpts) Validate() error {
+	switch t.verifyMode() {
+	case TLSVerifyFull, TLSVerifyCA, TLSSkipVerify:
+	default:
+		return fmt.Errorf("unknown TLS verify mode %q", t.Verify)
+	}
+	if (t.CertFile == "") != (t.KeyFile == "") {
+		return errors.New("TLS client certificate and key must be set together")
+	}
+	return nil
+}
+
+// Config builds a *tls.Config for connecting to host.
+func (t *TLSOpts) Config(host string) (*tls.Config, error) {
+	if err := t.Validate(); err != nil {
+		return nil, err
+	}
+
+	cfg := &tls.Config{ServerName: t.ServerName}
+	if cfg.ServerName == "" {
+		cfg.ServerName = host
+	}
+	if t.CAFile != "" {
+		pem, err := ioutil.ReadFile(t.CAFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "error reading TLS CA file")
+		}
+		cfg.RootCAs = x509.NewCertPool()
+		if !cfg.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in TLS CA file %s", t.CAFile)
+		}
+	}
+	if t.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(t.CertFile, t.KeyFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "error loading TLS client certificate")
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+
+	switch t.verifyMode() {
+	case TLSVerifyCA:
+		// crypto/tls can't skip only the host name check, so verify the
+		// chain ourselves.
+		cfg.InsecureSkipVerify = true
+		cfg.VerifyPeerCertificate = verifyChain(cfg.RootCAs)
+	case TLSSkipVerify:
+		cfg.InsecureSkipVerify = true
+	}
+	return cfg, nil
+}
+
+func verifyChain(roots *x509.CertPool) func([][]byte, [][]*x509.Certificate) error {
+	return func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+		if len(rawCerts) == 0 {
+			return errors.New("server sent no TLS certificate")
+		}
+		certs := make([]*x509.Certificate, len(rawCerts))
+		for i, raw := range rawCerts {
+			cert, err := x509.ParseCertificate(raw)
+			if err != nil {
+				return errors.Wrap(err, "error parsing server TLS certificate")
+			}
+			certs[i] = cert
+		}
+		opts := x509.VerifyOptions{Roots: roots, Intermediates: x509.NewCertPool()}
+		for _, cert := range certs[1:] {
+			opts.Intermediates.AddCert(cert)
+		}
+		_, err := certs[0].Verify(opts)
+		return err
+	}
+}
+
+// postgresSSLParams maps TLSOpts onto lib/pq's sslmode and file parameters.
+// lib/pq always checks the certificate against the connection host, so
+// ServerName has no effect for Postgres.
+func (t *TLSOpts) postgresSSLParams() map[string]string {
+	params := make(map[string]string)
+	switch t.verifyMode() {
+	case TLSVerifyFull:
+		params["sslmode"] = "verify-full"
+	case TLSVerifyCA:
+		params["sslmode"] = "verify-ca"
+	default:
+		params["sslmode"] = "require"
+	}
+	if t.CAFile != "" {
+		params["sslrootcert"] = t.CAFile
+	}
+	if t.CertFile != "" {
+		params["sslcert"] = t.CertFile
+		params["sslkey"] = t.KeyFile
+	}
+	return params
+}
@@ -0,0 +1,145 @@
+package example
+
+import (
+	"context"
+	"github.com/akikistyle/caplibgo/cache"
+	"github.com/akikistyle/caplibgo/db"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func Test_LocalStore(t *testing.T) {
+	ctx := context.Background()
+	get := func(s *cache.LocalStore, key string) bool {
+		_, err := s.Get(ctx, key)
+		return err == nil
+	}
+
+	lru := cache.NewLocalStore(cache.LocalOptions{MaxEntries: 2, Policy: cache.LRU})
+	lru.Set(ctx, "a", []byte("1"), 0)
+	lru.Set(ctx, "b", []byte("2"), 0)
+	get(lru, "a")
+	lru.Set(ctx, "c", []byte("3"), 0)
+	assert.True(t, get(lru, "a"))
+	assert.False(t, get(lru, "b"), "least recently used is evicted")
+	assert.True(t, get(lru, "c"))
+
+	lfu := cache.NewLocalStore(cache.LocalOptions{MaxEntries: 2, Policy: cache.LFU})
+	lfu.Set(ctx, "a", []byte("1"), 0)
+	lfu.Set(ctx, "b", []byte("2"), 0)
+	get(lfu, "a")
+	get(lfu, "a")
+	get(lfu, "b")
+	lfu.Set(ctx, "c", []byte("3"), 0)
+	assert.True(t, get(lfu, "c"), "a new key is never evicted by its own Set")
+	assert.True(t, get(lfu, "a"))
+	assert.False(t, get(lfu, "b"), "least frequently used is evicted")
+
+	// a warm store still takes new keys
+	warm := cache.NewLocalStore(cache.LocalOptions{MaxEntries: 3, Policy: cache.LFU})
+	for _, key := range []string{"a", "b", "c"} {
+		warm.Set(ctx, key, []byte(key), 0)
+	}
+	for i := 0; i < 3; i++ {
+		for _, key := range []string{"a", "b", "c"} {
+			get(warm, key)
+		}
+	}
+	warm.Set(ctx, "d", []byte("d"), 0)
+	assert.True(t, get(warm, "d"))
+	assert.Equal(t, 3, warm.Len())
+
+	sized := cache.NewLocalStore(cache.LocalOptions{MaxBytes: 10})
+	sized.Set(ctx, "a", []byte("12345"), 0)
+	sized.Set(ctx, "b", []byte("12345"), 0)
+	assert.Equal(t, 1, sized.Len())
+	sized.Set(ctx, "c", []byte("too large to fit"), 0)
+	assert.False(t, get(sized, "c"))
+
+	// values are copied in and out
+	buf := []byte("abc")
+	sized.Set(ctx, "d", buf, 0)
+	buf[0] = 'x'
+	val, _ := sized.Get(ctx, "d")
+	val[1] = 'y'
+	val, _ = sized.Get(ctx, "d")
+	assert.Equal(t, "abc", string(val))
+
+	ttl := cache.NewLocalStore(cache.LocalOptions{})
+	ttl.Set(ctx, "a", []byte("1"), 10*time.Millisecond)
+	assert.True(t, get(ttl, "a"))
+	time.Sleep(20 * time.Millisecond)
+	_, err := ttl.Get(ctx, "a")
+	assert.Equal(t, db.ErrCacheMiss, err)
+}
+
+func Test_TieredInvalidation(t *testing.T) {
+	_, r := newTestRedis(t)
+	ctx := context.Background()
+	newTier := func() *cache.Tiered {
+		tier, err := cache.NewTiered(r, cache.NewLocalStore(cache.LocalOptions{MaxEntries: 100}), cache.TieredOptions{LocalTTL: time.Minute})
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { tier.Close() })
+		return tier
+	}
+	a, b := newTier(), newTier()
+
+	assert.NoError(t, a.Set(ctx, "k", []byte("v1"), time.Hour))
+	val, err := b.Get(ctx, "k")
+	assert.NoError(t, err)
+	assert.Equal(t, "v1", string(val))
+	// the invalidation of a's write may still be on its way and keep b from
+	// filling its local tier on the first read
+	assert.Eventually(t, func() bool {
+		b.Get(ctx, "k")
+		_, err := b.Local.Get(ctx, "k")
+		return err == nil
+	}, time.Second, 5*time.Millisecond, "read through to the local tier")
+
+	// a write on one replica evicts the local copy of the other
+	assert.NoError(t, a.Set(ctx, "k", []byte("v2"), time.Hour))
+	assert.Eventually(t, func() bool {
+		_, err := b.Local.Get(ctx, "k")
+		return err == db.ErrCacheMiss
+	}, time.Second, 5*time.Millisecond)
+	val, err = b.Get(ctx, "k")
+	assert.NoError(t, err)
+	assert.Equal(t, "v2", string(val))
+	_, err = a.Local.Get(ctx, "k")
+	assert.NoError(t, err, "own writes are not invalidated")
+
+	assert.NoError(t, b.Delete(ctx, "k"))
+	assert.Eventually(t, func() bool {
+		_, err := a.Get(ctx, "k")
+		return err == db.ErrCacheMiss
+	}, time.Second, 5*time.Millisecond)
+
+	// the typed cache works on top of it
+	c := cache.New[string](a)
+	assert.NoError(t, c.Set(ctx, "name", "ann", time.Hour))
+	name, err := cache.New[string](b).Get(ctx, "name")
+	assert.NoError(t, err)
+	assert.Equal(t, "ann", name)
+}
+
+func Test_TieredReconnect(t *testing.T) {
+	s, r := newTestRedis(t)
+	ctx := context.Background()
+	tier, err := cache.NewTiered(r, cache.NewLocalStore(cache.LocalOptions{}), cache.TieredOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tier.Close()
+
+	assert.NoError(t, tier.Set(ctx, "k", []byte("v1"), 0))
+	assert.Equal(t, 1, tier.Local.Len())
+
+	// invalidations sent while the subscription is down are lost, so the
+	// local tier is purged once it is back
+	s.Close()
+	assert.NoError(t, s.Restart())
+	assert.Eventually(t, func() bool { return tier.Local.Len() == 0 }, 5*time.Second, 10*time.Millisecond)
+}
@@ -0,0 +1,133 @@
+package example
+
+import (
+	"context"
+	"github.com/akikistyle/caplibgo/cache"
+	"github.com/akikistyle/caplibgo/db"
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type profile struct {
+	Name string
+	Bio  string
+	Tags []string
+}
+
+func Test_CacheCodecs(t *testing.T) {
+	in := profile{Name: "ann", Bio: strings.Repeat("go ", 100), Tags: []string{"a", "b"}}
+	codecs := map[string]cache.Codec{
+		"json":       cache.JSON,
+		"gob":        cache.Gob,
+		"msgpack":    cache.Msgpack,
+		"compressed": cache.Compress(cache.JSON, 64),
+		"small":      cache.Compress(cache.Msgpack, 1<<20),
+	}
+	for name, c := range codecs {
+		data, err := c.Marshal(in)
+		assert.NoError(t, err, name)
+		var out profile
+		assert.NoError(t, c.Unmarshal(data, &out), name)
+		assert.Equal(t, in, out, name)
+	}
+	plain, _ := cache.JSON.Marshal(in)
+	packed, _ := cache.Compress(cache.JSON, 64).Marshal(in)
+	assert.True(t, len(packed) < len(plain))
+}
+
+func Test_CacheGetOrLoad(t *testing.T) {
+	s, r := newTestRedis(t)
+	ctx := context.Background()
+	c := cache.New[profile](cache.NewRedisStore(r), cache.WithPrefix("profile:"),
+		cache.WithNegativeTTL(time.Minute), cache.WithJitter(0.1), cache.WithCodec(cache.Msgpack))
+
+	_, err := c.Get(ctx, "ann")
+	assert.Equal(t, db.ErrCacheMiss, err)
+
+	// concurrent misses share a single load
+	var loads int32
+	loader := func(ctx context.Context) (profile, error) {
+		atomic.AddInt32(&loads, 1)
+		time.Sleep(20 * time.Millisecond)
+		return profile{Name: "ann"}, nil
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			p, err := c.GetOrLoad(ctx, "ann", loader, time.Hour)
+			assert.NoError(t, err)
+			assert.Equal(t, "ann", p.Name)
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, int32(1), loads)
+	ttl := s.TTL("profile:ann")
+	assert.True(t, ttl >= 54*time.Minute && ttl <= 66*time.Minute, ttl)
+
+	// misses are cached too
+	notFound := func(ctx context.Context) (profile, error) {
+		atomic.AddInt32(&loads, 1)
+		return profile{}, cache.ErrNotFound
+	}
+	for i := 0; i < 2; i++ {
+		_, err = c.GetOrLoad(ctx, "bob", notFound, time.Hour)
+		assert.Equal(t, cache.ErrNotFound, err)
+	}
+	assert.Equal(t, int32(2), loads)
+
+	assert.NoError(t, c.Delete(ctx, "ann", "bob"))
+	_, err = c.Get(ctx, "bob")
+	assert.Equal(t, db.ErrCacheMiss, err)
+}
+
+func Test_CacheGetOrLoadCancel(t *testing.T) {
+	_, r := newTestRedis(t)
+	c := cache.New[profile](cache.NewRedisStore(r), cache.WithPrefix("profile:"))
+
+	// the first caller gives up; the shared load keeps going for the second
+	release := make(chan struct{})
+	started := make(chan struct{})
+	var loadErr error
+	loader := func(ctx context.Context) (profile, error) {
+		close(started)
+		<-release
+		loadErr = ctx.Err()
+		return profile{Name: "ann"}, nil
+	}
+	first, cancel := context.WithCancel(context.Background())
+	firstErr := make(chan error, 1)
+	go func() {
+		_, err := c.GetOrLoad(first, "ann", loader, time.Hour)
+		firstErr <- err
+	}()
+	<-started
+	second := make(chan profile, 1)
+	go func() {
+		p, err := c.GetOrLoad(context.Background(), "ann", loader, time.Hour)
+		assert.NoError(t, err)
+		second <- p
+	}()
+
+	cancel()
+	assert.Equal(t, context.Canceled, <-firstErr)
+	close(release)
+	assert.Equal(t, "ann", (<-second).Name)
+	assert.NoError(t, loadErr)
+	p, err := c.Get(context.Background(), "ann")
+	assert.NoError(t, err)
+	assert.Equal(t, "ann", p.Name)
+
+	// WithLoadTimeout still bounds a load nobody cancels
+	c = cache.New[profile](cache.NewRedisStore(r), cache.WithPrefix("slow:"), cache.WithLoadTimeout(20*time.Millisecond))
+	_, err = c.GetOrLoad(context.Background(), "bob", func(ctx context.Context) (profile, error) {
+		<-ctx.Done()
+		return profile{}, ctx.Err()
+	}, time.Hour)
+	assert.Equal(t, context.DeadlineExceeded, err)
+}
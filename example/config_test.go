@@ -0,0 +1,136 @@
+package example
+
+import (
+	"github.com/akikistyle/caplibgo/db"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func Test_LoadOpts(t *testing.T) {
+	dir := t.TempDir()
+	secret := filepath.Join(dir, "password")
+	assert.NoError(t, ioutil.WriteFile(secret, []byte("s3cret\n"), 0600))
+
+	t.Setenv("PG_URL", "postgres://app@pg.local/app?sslmode=require")
+	t.Setenv("PG_PORT", "5433")
+	t.Setenv("PG_PASSWORD_FILE", secret)
+	t.Setenv("PG_TIMEOUT", "1m30s")
+	t.Setenv("PG_MAX_IDLE", "4")
+	t.Setenv("PG_RETRY_MAX_ATTEMPTS", "2")
+
+	opt, err := db.LoadOpts("PG")
+	assert.NoError(t, err)
+	assert.Equal(t, "pg.local", opt.Host)
+	assert.Equal(t, 5433, opt.Port)
+	assert.Equal(t, "app", opt.User)
+	assert.Equal(t, "s3cret", opt.Password)
+	assert.Equal(t, 90*time.Second, opt.Timeout)
+	assert.Equal(t, 4, opt.MaxIdle)
+	assert.True(t, opt.Authorization)
+	assert.Equal(t, "require", opt.Options["sslmode"])
+	assert.Equal(t, 2, opt.Retry.MaxAttempts)
+	assert.Equal(t, db.DefaultRetryPolicy.InitialBackoff, opt.Retry.InitialBackoff)
+
+	t.Setenv("MONGO_ADDRS", "m1:27017,m2:27017")
+	t.Setenv("MONGO_REPLICA_SET", "rs0")
+	t.Setenv("MONGO_READ_PREFERENCE", "nearest")
+	t.Setenv("MONGO_WRITE_TIMEOUT", "2s")
+	opt, err = db.LoadOpts("MONGO")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"m1:27017", "m2:27017"}, opt.Addrs)
+	assert.Equal(t, &db.MongoOpts{ReplicaSet: "rs0", ReadPreference: "nearest", WriteTimeout: 2 * time.Second}, opt.Mongo)
+	t.Setenv("MONGO_READ_PREFERENCE", "anywhere")
+	_, err = db.LoadOpts("MONGO")
+	assert.Error(t, err)
+
+	t.Setenv("BAD_PORT", "five")
+	t.Setenv("BAD_TIMEOUT", "soon")
+	t.Setenv("BAD_PASSWORD", "x")
+	t.Setenv("BAD_PASSWORD_FILE", secret)
+	_, err = db.LoadOpts("BAD")
+	if oe, ok := err.(*db.OptsError); assert.True(t, ok) {
+		assert.Len(t, oe.Errs, 5)
+		assert.Contains(t, err.Error(), "BAD_HOST is required")
+		assert.Contains(t, err.Error(), `BAD_PORT: "five" is not a number`)
+	}
+}
+
+func Test_LoadOptsFile(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"db.yaml": "host: cache\nport: 6380\ndatabase: \"1\"\ntimeout: 4m\nretry:\n  max_attempts: 3\n",
+		"db.json": `{"host": "cache", "port": 6380, "database": "1", "timeout": "4m", "retry": {"max_attempts": 3}}`,
+		"db.toml": "host = \"cache\"\nport = 6380\ndatabase = \"1\"\ntimeout = \"4m\"\n[retry]\nmax_attempts = 3\n",
+	}
+	for name, content := range files {
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join(dir, name)
+			assert.NoError(t, ioutil.WriteFile(path, []byte(content), 0600))
+
+			opt, err := db.LoadOptsFile(path)
+			assert.NoError(t, err)
+			assert.Equal(t, "cache", opt.Host)
+			assert.Equal(t, 6380, opt.Port)
+			assert.Equal(t, "1", opt.Database)
+			assert.Equal(t, 4*time.Minute, opt.Timeout)
+			assert.Equal(t, 3, opt.Retry.MaxAttempts)
+		})
+	}
+
+	path := filepath.Join(dir, "empty.json")
+	assert.NoError(t, ioutil.WriteFile(path, []byte(`{"max_idle": -1}`), 0600))
+	_, err := db.LoadOptsFile(path)
+	assert.EqualError(t, err, "invalid database options from "+path+
+		": host is required; port must be between 1 and 65535, got 0; max_idle must not be negative")
+}
+
+func Test_LoadOptsFileMongoMerge(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "mongo.yaml")
+	assert.NoError(t, ioutil.WriteFile(path, []byte(
+		"url: mongodb+srv://app@cluster.example.com/app?replicaSet=rs0\nmongo:\n  read_preference: nearest\n"), 0600))
+
+	opt, err := db.LoadOptsFile(path)
+	assert.NoError(t, err)
+	assert.Equal(t, &db.MongoOpts{SRV: true, ReplicaSet: "rs0", ReadPreference: "nearest"}, opt.Mongo)
+
+	t.Setenv("MERGE_CONFIG_FILE", path)
+	t.Setenv("MERGE_URL", "mongodb+srv://app@cluster.example.com/app?w=majority")
+	opt, err = db.LoadOpts("MERGE")
+	assert.NoError(t, err)
+	assert.Equal(t, &db.MongoOpts{SRV: true, ReplicaSet: "rs0", ReadPreference: "nearest", WriteConcern: "majority"}, opt.Mongo)
+}
+
+func Test_LoadOptsFileUnknownKey(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"db.yaml": "host: cache\nprot: 6380\n",
+		"db.json": `{"host": "cache", "prot": 6380}`,
+		"db.toml": "host = \"cache\"\nprot = 6380\n",
+	}
+	for name, content := range files {
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join(dir, name)
+			assert.NoError(t, ioutil.WriteFile(path, []byte(content), 0600))
+
+			_, err := db.LoadOptsFile(path)
+			if assert.Error(t, err) {
+				assert.Contains(t, err.Error(), "prot")
+			}
+		})
+	}
+}
+
+func Test_LoadOptsConfigFileError(t *testing.T) {
+	t.Setenv("CFG_CONFIG_FILE", filepath.Join(t.TempDir(), "missing.yaml"))
+	t.Setenv("CFG_PORT", "five")
+	_, err := db.LoadOpts("CFG")
+	if _, ok := err.(*db.OptsError); assert.True(t, ok) {
+		assert.Contains(t, err.Error(), "CFG_CONFIG_FILE: error reading database config file")
+		assert.Contains(t, err.Error(), `CFG_PORT: "five" is not a number`)
+		assert.Contains(t, err.Error(), "CFG_HOST is required")
+	}
+}
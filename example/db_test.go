@@ -1,13 +1,21 @@
 package example
 
 import (
+	"context"
+	"errors"
 	"github.com/akikistyle/caplibgo/db"
+	"github.com/alicebob/miniredis/v2"
 	"github.com/stretchr/testify/assert"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
 	"testing"
 	"time"
 )
 
 func Test_NewPool(t *testing.T) {
+	s := miniredis.RunT(t)
 	tests := []struct {
 		name          string
 		wantErr       bool
@@ -39,9 +47,9 @@ func Test_NewPool(t *testing.T) {
 			name:          "Redis",
 			wantErr:       false,
 			driver:        "redis",
-			host:          "",
-			port:          0,
-			database:      "",
+			host:          s.Host(),
+			port:          mustPort(t, s.Port()),
+			database:      "0",
 			timeout:       240 * time.Second,
 			maxIdle:       30,
 			maxActive:     1000,
@@ -67,6 +75,7 @@ func Test_NewPool(t *testing.T) {
 				MaxIdle:       test.maxIdle,
 				MaxActive:     test.maxActive,
 				Authorization: test.authorization,
+				Retry:         &db.RetryPolicy{MaxAttempts: 1},
 			}
 			rsp, err := db.NewPool(test.driver, opt)
 			if test.wantErr {
@@ -79,3 +88,108 @@ func Test_NewPool(t *testing.T) {
 		})
 	}
 }
+
+type fakeDB struct {
+	opt       *db.DBOpts
+	connected bool
+	pingErr   error
+}
+
+func (f *fakeDB) Connect() error                           { return f.ConnectContext(context.Background()) }
+func (f *fakeDB) ConnectContext(ctx context.Context) error { f.connected = true; return ctx.Err() }
+func (f *fakeDB) Close()                                   { f.connected = false }
+func (f *fakeDB) CloseContext(ctx context.Context) error   { f.Close(); return nil }
+func (f *fakeDB) Option() *db.DBOpts                       { return f.opt }
+func (f *fakeDB) DBSource() string                         { return "fake://" }
+func (f *fakeDB) Ping(ctx context.Context) error           { return f.pingErr }
+func (f *fakeDB) Health(ctx context.Context) *db.Health {
+	return &db.Health{Healthy: f.pingErr == nil, Err: f.pingErr, Class: db.ClassifyError(f.pingErr)}
+}
+
+func Test_Register(t *testing.T) {
+	db.Register("fake", func(opt *db.DBOpts) db.DBManager {
+		return &fakeDB{opt: opt}
+	})
+
+	assert.Subset(t, db.Drivers(), []string{"fake", "mongodb", "mysql", "postgres", "redis"})
+	assert.Panics(t, func() {
+		db.Register("fake", func(opt *db.DBOpts) db.DBManager { return nil })
+	})
+
+	opt := &db.DBOpts{Host: "localhost"}
+	rsp, err := db.NewPool("fake", opt)
+	assert.NoError(t, err)
+	assert.True(t, rsp.(*fakeDB).connected)
+	assert.Equal(t, opt, rsp.Option())
+
+	rsp, err = db.NewPool("unknown", opt)
+	assert.Error(t, err)
+	assert.Nil(t, rsp)
+}
+
+func Test_NewPoolContext(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	rsp, err := db.NewPoolContext(ctx, "postgres", &db.DBOpts{Host: "127.0.0.1", Port: 1, User: "u", Password: "p", Database: "d"})
+	assert.Error(t, err)
+	assert.Nil(t, rsp)
+	assert.True(t, time.Since(start) < time.Second)
+}
+
+func Test_HealthChecker(t *testing.T) {
+	s := miniredis.RunT(t)
+	r, err := db.NewRedis(&db.DBOpts{Host: s.Host(), Port: mustPort(t, s.Port()), Database: "0", MaxIdle: 1})
+	assert.NoError(t, err)
+	defer r.Close()
+
+	hc := db.NewHealthChecker(time.Second)
+	hc.Add("redis", r)
+
+	hl := r.Health(context.Background())
+	assert.True(t, hl.Healthy)
+	assert.Equal(t, db.ErrorClassNone, hl.Class)
+	assert.Equal(t, 1, hl.Stats.Idle)
+
+	rec := httptest.NewRecorder()
+	hc.ServeHTTP(rec, httptest.NewRequest("GET", "/readyz", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+
+	hc.Add("fake", &fakeDB{pingErr: &net.OpError{Op: "dial", Err: errors.New("connection refused")}})
+	rec = httptest.NewRecorder()
+	hc.ReadinessHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/readyz", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, rec.Code)
+	assert.Contains(t, rec.Body.String(), `"class":"unavailable"`)
+
+	rec = httptest.NewRecorder()
+	hc.LivenessHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/healthz", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+}
+
+func mustPort(t *testing.T, port string) int {
+	p, err := strconv.Atoi(port)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func Test_RetryPolicy(t *testing.T) {
+	policy := &db.RetryPolicy{MaxAttempts: 3, InitialBackoff: 10 * time.Millisecond, MaxBackoff: 15 * time.Millisecond, Multiplier: 2}
+	assert.Equal(t, 10*time.Millisecond, policy.Backoff(1))
+	assert.Equal(t, 15*time.Millisecond, policy.Backoff(2))
+
+	for _, driver := range []string{"postgres", "redis"} {
+		t.Run(driver, func(t *testing.T) {
+			rsp, err := db.NewPool(driver, &db.DBOpts{Host: "127.0.0.1", Port: 1, User: "u", Password: "p", Database: "0", Retry: policy})
+			assert.Nil(t, rsp)
+
+			var cerr *db.ConnectError
+			if assert.True(t, errors.As(err, &cerr)) {
+				assert.Equal(t, 3, cerr.Attempts)
+				assert.Equal(t, db.ErrorClassUnavailable, db.ClassifyError(cerr))
+			}
+		})
+	}
+}
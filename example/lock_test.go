@@ -0,0 +1,87 @@
+package example
+
+import (
+	"context"
+	"github.com/akikistyle/caplibgo/db"
+	"github.com/akikistyle/caplibgo/lock"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func Test_Lock(t *testing.T) {
+	s, r := newTestRedis(t)
+	ctx := context.Background()
+	locker := lock.New(r, lock.WithPrefix("lock:"))
+
+	l, err := locker.Acquire(ctx, "job", time.Minute)
+	assert.NoError(t, err)
+	assert.Equal(t, "lock:job", l.Key)
+	assert.True(t, l.Validity() > 0)
+	_, err = locker.Acquire(ctx, "job", time.Minute)
+	assert.Equal(t, lock.ErrNotAcquired, err)
+
+	assert.NoError(t, l.Extend(ctx, 2*time.Minute))
+	assert.Equal(t, 2*time.Minute, s.TTL("lock:job"))
+
+	// Wait gets the lock once it is released
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		l.Release(ctx)
+	}()
+	wctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	l2, err := locker.Wait(wctx, "job", time.Minute)
+	assert.NoError(t, err)
+	assert.NotEqual(t, l.Token(), l2.Token())
+
+	// the old holder can neither release nor extend the new lock
+	assert.Equal(t, lock.ErrLockLost, l.Release(ctx))
+	assert.Equal(t, lock.ErrLockLost, l.Extend(ctx, time.Minute))
+
+	// an expired lease is lost
+	s.FastForward(2 * time.Minute)
+	assert.Equal(t, lock.ErrLockLost, l2.Extend(ctx, time.Minute))
+
+	wctx, cancel = context.WithTimeout(ctx, 100*time.Millisecond)
+	defer cancel()
+	_, err = locker.Acquire(ctx, "held", time.Minute)
+	assert.NoError(t, err)
+	_, err = locker.Wait(wctx, "held", time.Minute)
+	assert.Error(t, err)
+}
+
+func Test_Redlock(t *testing.T) {
+	var clients []*db.Redis
+	for i := 0; i < 3; i++ {
+		_, r := newTestRedis(t)
+		clients = append(clients, r)
+	}
+	ctx := context.Background()
+	locker := lock.NewRedlock(clients)
+
+	// one server already holds a stale lock: the majority still wins
+	ok, err := clients[0].SetNX(ctx, "job", "someone-else", time.Minute)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	l, err := locker.Acquire(ctx, "job", time.Minute)
+	assert.NoError(t, err)
+	assert.NoError(t, l.Extend(ctx, time.Minute))
+
+	// two servers held by others means no quorum, and nothing is left behind
+	ok, err = clients[1].SetNX(ctx, "other", "someone-else", time.Minute)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	_, err = clients[0].SetNX(ctx, "other", "someone-else", time.Minute)
+	assert.NoError(t, err)
+	_, err = locker.Acquire(ctx, "other", time.Minute)
+	assert.Equal(t, lock.ErrNotAcquired, err)
+	_, err = clients[2].Get("other")
+	assert.Equal(t, db.ErrCacheMiss, err)
+
+	assert.NoError(t, l.Release(ctx))
+	for _, r := range clients[1:] {
+		_, err := r.Get("job")
+		assert.Equal(t, db.ErrCacheMiss, err)
+	}
+}
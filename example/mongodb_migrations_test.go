@@ -0,0 +1,67 @@
+package example
+
+import (
+	"context"
+	"github.com/akikistyle/caplibgo/db"
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson"
+	"os"
+	"testing"
+)
+
+var mongoMigrations = map[string]string{
+	"1_users.up.json": `[
+		{"create": "users"},
+		{"createIndexes": "users", "indexes": [{"key": {"email": 1}, "name": "email", "unique": true}]}
+	]`,
+	"1_users.down.json": `{"drop": "users"}`,
+	"2_admin.up.json":   `{"insert": "users", "documents": [{"email": "admin@example.com", "created": {"$date": "2020-01-01T00:00:00Z"}}]}`,
+	"2_admin.down.json": `{"delete": "users", "deletes": [{"q": {"email": "admin@example.com"}, "limit": 1}]}`,
+}
+
+func mongoAssets() ([]string, func(name string) ([]byte, error)) {
+	var names []string
+	for name := range mongoMigrations {
+		names = append(names, name)
+	}
+	return names, func(name string) ([]byte, error) {
+		data, ok := mongoMigrations[name]
+		if !ok {
+			return nil, os.ErrNotExist
+		}
+		return []byte(data), nil
+	}
+}
+
+// Test_MongoDBMigrations needs a local mongod, see newTestMongo.
+func Test_MongoDBMigrations(t *testing.T) {
+	m := newTestMongo(t)
+	ctx := context.Background()
+
+	var _ db.DBMigrations = m
+	conf := &db.DBMigrationsConfig{MigrationsItem: "schema_migrations"}
+	assets, afn := mongoAssets()
+	assert.NoError(t, m.MigrateUpIfRequired(conf, assets, afn))
+
+	n, err := m.Database().Collection("users").CountDocuments(ctx, bson.M{"email": "admin@example.com"})
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), n)
+	var version struct {
+		Version int  `bson:"version"`
+		Dirty   bool `bson:"dirty"`
+	}
+	assert.NoError(t, m.Database().Collection("schema_migrations").FindOne(ctx, bson.M{"_id": "version"}).Decode(&version))
+	assert.Equal(t, 2, version.Version)
+	assert.False(t, version.Dirty)
+
+	// nothing left to do
+	assert.NoError(t, m.MigrateUpIfRequired(conf, assets, afn))
+	assert.NoError(t, m.MigrateUp(conf, assets, afn))
+
+	// a failed migration leaves the database dirty
+	mongoMigrations["3_broken.up.json"] = `{"noSuchCommand": 1}`
+	defer delete(mongoMigrations, "3_broken.up.json")
+	assets, afn = mongoAssets()
+	assert.Error(t, m.MigrateUp(conf, assets, afn))
+	assert.Error(t, m.MigrateUpIfRequired(conf, assets, afn), "dirty database")
+}
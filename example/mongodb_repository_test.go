@@ -0,0 +1,136 @@
+package example
+
+import (
+	"context"
+	"github.com/akikistyle/caplibgo/db"
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"os"
+	"testing"
+)
+
+// newTestMongo connects to MONGODB_TEST_URL, e.g.
+// mongodb://localhost:27017/caplibgo_test, and drops its database first. The
+// test is skipped when the variable is not set.
+func newTestMongo(t *testing.T) *db.MongoDB {
+	raw := os.Getenv("MONGODB_TEST_URL")
+	if raw == "" {
+		t.Skip("MONGODB_TEST_URL is not set")
+	}
+	_, opt, err := db.ParseURL(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := db.NewMongoDB(opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { m.Close() })
+	if err := m.Database().Drop(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+func Test_Filter(t *testing.T) {
+	f := db.NewFilter().Eq("status", "active").Gte("age", 18).Lt("age", 65).In("role", "admin", "dev").
+		Or(db.NewFilter().Exists("deleted", false), db.NewFilter().Eq("deleted", nil))
+	assert.Equal(t, bson.D{
+		{Key: "status", Value: "active"},
+		{Key: "age", Value: bson.D{{Key: "$gte", Value: 18}, {Key: "$lt", Value: 65}}},
+		{Key: "role", Value: bson.D{{Key: "$in", Value: []interface{}{"admin", "dev"}}}},
+		{Key: "$or", Value: bson.A{
+			bson.D{{Key: "deleted", Value: bson.D{{Key: "$exists", Value: false}}}},
+			bson.D{{Key: "deleted", Value: nil}},
+		}},
+	}, f.Doc())
+
+	assert.NoError(t, f.Err())
+
+	// an equality on a sub-document is not an operator document to merge
+	// into
+	f = db.NewFilter().Eq("address", bson.D{{Key: "city", Value: "Oslo"}}).Gt("address", 1)
+	assert.Equal(t, bson.D{{Key: "address", Value: bson.D{{Key: "city", Value: "Oslo"}}}}, f.Doc())
+	assert.Error(t, f.Err())
+	assert.Error(t, db.NewFilter().Gt("age", 1).Eq("age", 2).Err())
+	assert.Error(t, db.NewFilter().Or(db.NewFilter().Eq("a", 1).Eq("a", 2)).Err())
+
+	m := newOfflineMongo(t)
+	_, err := db.NewRepository[account](m, "users").Count(context.Background(), f)
+	assert.Equal(t, f.Err(), err, "rejected before querying")
+
+	var none *db.Filter
+	assert.Equal(t, bson.D{}, none.Doc())
+	assert.NoError(t, none.Err())
+	assert.Equal(t, bson.D{{Key: "a", Value: 1}}, none.Eq("a", 1).Doc())
+	assert.Equal(t, bson.D{{Key: "a", Value: bson.D{{Key: "$gt", Value: 1}}}}, none.Gt("a", 1).Doc())
+
+	// an empty Or adds nothing, repeated ones must all match
+	assert.Equal(t, bson.D{{Key: "a", Value: 1}}, db.NewFilter().Eq("a", 1).Or().Doc())
+	or := func(field string) *db.Filter {
+		return db.NewFilter().Or(db.NewFilter().Eq(field, 1), db.NewFilter().Eq(field, 2))
+	}
+	orDoc := func(field string) bson.D { return or(field).Doc() }
+	assert.Equal(t, bson.D{{Key: "$and", Value: bson.A{orDoc("a"), orDoc("b"), orDoc("c")}}},
+		or("a").Or(db.NewFilter().Eq("b", 1), db.NewFilter().Eq("b", 2)).
+			Or(db.NewFilter().Eq("c", 1), db.NewFilter().Eq("c", 2)).Doc())
+	assert.Equal(t, bson.D{{Key: "created", Value: -1}, {Key: "name", Value: 1}}, db.SortBy("-created", "name"))
+}
+
+type account struct {
+	ID    primitive.ObjectID `bson:"_id,omitempty"`
+	Email string             `bson:"email"`
+	Age   int                `bson:"age"`
+}
+
+func Test_Repository(t *testing.T) {
+	m := newTestMongo(t)
+	ctx := context.Background()
+	users := db.NewRepository[account](m, "users")
+
+	_, err := users.EnsureIndexes(ctx, db.Index(true, "email"))
+	assert.NoError(t, err)
+
+	var ids []interface{}
+	for i, email := range []string{"a@x.io", "b@x.io", "c@x.io", "d@x.io", "e@x.io"} {
+		id, err := users.Insert(ctx, &account{Email: email, Age: 20 + i})
+		assert.NoError(t, err)
+		ids = append(ids, id)
+	}
+	_, err = users.Insert(ctx, &account{Email: "a@x.io"})
+	assert.True(t, mongo.IsDuplicateKeyError(err), "%v", err)
+
+	u, err := users.FindByID(ctx, ids[1])
+	assert.NoError(t, err)
+	assert.Equal(t, "b@x.io", u.Email)
+	_, err = users.FindByID(ctx, primitive.NewObjectID())
+	assert.Equal(t, db.ErrNotFound, err)
+
+	docs, p, err := users.FindPage(ctx, db.NewFilter().Gte("age", 21), 2, 2, "-age")
+	assert.NoError(t, err)
+	assert.Equal(t, 4, p.RecordCount)
+	assert.Equal(t, 2, p.PageCount)
+	if assert.Len(t, docs, 2) {
+		assert.Equal(t, "c@x.io", docs[0].Email)
+		assert.Equal(t, "b@x.io", docs[1].Email)
+	}
+
+	assert.NoError(t, users.UpdateFields(ctx, ids[0], bson.M{"age": 99}))
+	u, _ = users.FindByID(ctx, ids[0])
+	assert.Equal(t, 99, u.Age)
+	assert.Equal(t, db.ErrNotFound, users.UpdateFields(ctx, primitive.NewObjectID(), bson.M{"age": 1}))
+
+	assert.NoError(t, users.Upsert(ctx, db.NewFilter().Eq("email", "f@x.io"), &account{Email: "f@x.io", Age: 30}))
+	assert.NoError(t, users.Upsert(ctx, db.NewFilter().Eq("email", "f@x.io"), &account{Email: "f@x.io", Age: 31}))
+	n, err := users.Count(ctx, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(6), n)
+
+	assert.NoError(t, users.Delete(ctx, ids[4]))
+	assert.Equal(t, db.ErrNotFound, users.Delete(ctx, ids[4]))
+	n, err = users.DeleteMany(ctx, db.NewFilter().Regex("email", "^[ab]@", ""))
+	assert.NoError(t, err)
+	assert.Equal(t, int64(2), n)
+}
@@ -0,0 +1,52 @@
+package example
+
+import (
+	"context"
+	"github.com/akikistyle/caplibgo/db"
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"testing"
+	"time"
+)
+
+func Test_MongoDBConnectError(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+	m := &db.MongoDB{Opt: &db.DBOpts{Host: "127.0.0.1", Port: 1, Database: "app", MaxIdle: 5, Timeout: time.Second,
+		Retry: &db.RetryPolicy{MaxAttempts: 1}}}
+
+	err := m.ConnectContext(ctx)
+	_, ok := err.(*db.ConnectError)
+	assert.True(t, ok, "%v", err)
+	assert.Nil(t, m.Client, "a failed connect leaves no dead client behind")
+	assert.Nil(t, m.DB)
+
+	h := m.Health(context.Background())
+	assert.False(t, h.Healthy)
+	assert.Equal(t, db.PoolStats{}, h.Stats)
+}
+
+func Test_MongoDBInvalidOpts(t *testing.T) {
+	m := &db.MongoDB{Opt: &db.DBOpts{Host: "127.0.0.1", Port: 1, Database: "app",
+		Mongo: &db.MongoOpts{ReadPreference: "anywhere"}}}
+	start := time.Now()
+	err := m.ConnectContext(context.Background())
+	assert.EqualError(t, err, `MongoDB options are invalid: unknown read preference "anywhere"`)
+	assert.Nil(t, m.Client, "rejected before connecting")
+	assert.Less(t, time.Since(start), time.Second)
+}
+
+// newOfflineMongo returns a MongoDB whose client points at a closed port.
+// The driver connects lazily, so it is usable for code paths that fail
+// before reaching the server.
+func newOfflineMongo(t *testing.T) *db.MongoDB {
+	client, err := mongo.Connect(context.Background(), options.Client().ApplyURI("mongodb://127.0.0.1:1").
+		SetServerSelectionTimeout(200*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := &db.MongoDB{Client: client, Opt: &db.DBOpts{Host: "127.0.0.1", Port: 1, Database: "app"}}
+	t.Cleanup(m.Close)
+	return m
+}
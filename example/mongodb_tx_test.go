@@ -0,0 +1,87 @@
+package example
+
+import (
+	"context"
+	"github.com/akikistyle/caplibgo/db"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Test_MongoDBTransaction needs MONGODB_TEST_URL to point at a replica set,
+// see Test_Watch.
+func Test_MongoDBTransaction(t *testing.T) {
+	m := newTestMongo(t)
+	ctx := context.Background()
+	accounts := db.NewRepository[account](m, "accounts")
+	// collections can not be created inside a transaction before 4.4
+	for _, email := range []string{"a@x.io", "b@x.io"} {
+		_, err := accounts.Insert(ctx, &account{Email: email, Age: 100})
+		assert.NoError(t, err)
+	}
+	move := func(sc mongo.SessionContext, from, to string, n int) error {
+		if _, err := accounts.Collection.UpdateOne(sc, bson.M{"email": from}, bson.M{"$inc": bson.M{"age": -n}}); err != nil {
+			return err
+		}
+		_, err := accounts.Collection.UpdateOne(sc, bson.M{"email": to}, bson.M{"$inc": bson.M{"age": n}})
+		return err
+	}
+	total := func() int {
+		docs, err := accounts.Find(ctx, nil)
+		assert.NoError(t, err)
+		sum := 0
+		for _, d := range docs {
+			sum += d.Age
+		}
+		return sum
+	}
+
+	failed := errors.New("rolled back")
+	err := m.WithTransaction(ctx, func(sc mongo.SessionContext) error {
+		if err := move(sc, "a@x.io", "b@x.io", 50); err != nil {
+			return err
+		}
+		return failed
+	})
+	assert.Equal(t, failed, err)
+	a, _ := accounts.FindOne(ctx, db.NewFilter().Eq("email", "a@x.io"))
+	assert.Equal(t, 100, a.Age)
+
+	// concurrent transfers conflict on the same documents and are retried
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			from, to := "a@x.io", "b@x.io"
+			if i%2 == 1 {
+				from, to = to, from
+			}
+			err := m.WithTransaction(ctx, func(sc mongo.SessionContext) error {
+				return move(sc, from, to, 10)
+			}, db.MongoTxReadConcern("snapshot"), db.MongoTxWriteConcern("majority", 5*time.Second), db.MongoTxTimeout(30*time.Second))
+			assert.NoError(t, err)
+		}(i)
+	}
+	wg.Wait()
+	assert.Equal(t, 200, total())
+	a, _ = accounts.FindOne(ctx, db.NewFilter().Eq("email", "a@x.io"))
+	assert.Equal(t, 100, a.Age)
+}
+
+func Test_MongoDBTransactionTimeout(t *testing.T) {
+	m := newOfflineMongo(t)
+
+	failed := errors.New("failed")
+	err := m.WithTransaction(context.Background(), func(sc mongo.SessionContext) error {
+		deadline, ok := sc.Deadline()
+		assert.True(t, ok, "fn runs under the transaction timeout")
+		assert.WithinDuration(t, time.Now().Add(time.Second), deadline, 100*time.Millisecond)
+		return failed
+	}, db.MongoTxTimeout(time.Second))
+	assert.Equal(t, failed, err)
+}
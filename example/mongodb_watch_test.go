@@ -0,0 +1,85 @@
+package example
+
+import (
+	"context"
+	"github.com/akikistyle/caplibgo/db"
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson"
+	"testing"
+	"time"
+)
+
+func Test_RedisTokenStore(t *testing.T) {
+	_, r := newTestRedis(t)
+	ctx := context.Background()
+	tokens := db.NewRedisTokenStore(r, "resume:")
+
+	token, err := tokens.Load(ctx, "app.users")
+	assert.NoError(t, err)
+	assert.Nil(t, token)
+
+	saved, _ := bson.Marshal(bson.D{{Key: "_data", Value: "8263A1"}})
+	assert.NoError(t, tokens.Save(ctx, "app.users", saved))
+	token, err = tokens.Load(ctx, "app.users")
+	assert.NoError(t, err)
+	assert.Equal(t, bson.Raw(saved), token)
+}
+
+func Test_ChangeEvent(t *testing.T) {
+	key, _ := bson.Marshal(bson.D{{Key: "_id", Value: "u1"}})
+	doc, _ := bson.Marshal(account{Email: "a@x.io", Age: 30})
+	ev := &db.ChangeEvent{OperationType: "insert", DocumentKey: key, FullDocument: doc}
+	assert.Equal(t, "u1", ev.DocumentID().StringValue())
+	var a account
+	assert.NoError(t, ev.Decode(&a))
+	assert.Equal(t, "a@x.io", a.Email)
+
+	ev = &db.ChangeEvent{OperationType: "delete", DocumentKey: key}
+	assert.Error(t, ev.Decode(&a))
+}
+
+// Test_Watch needs MONGODB_TEST_URL to point at a replica set, e.g.
+// mongodb://localhost:27017/caplibgo_test?replicaSet=rs0.
+func Test_Watch(t *testing.T) {
+	m := newTestMongo(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	users := db.NewRepository[account](m, "users")
+	tokens := db.NewMongoTokenStore(m, "resume_tokens")
+	_, err := users.Insert(ctx, &account{Email: "setup@x.io"})
+	assert.NoError(t, err)
+
+	cs, err := m.Watch(ctx, db.WatchOptions{Collection: "users", FullDocument: true, Tokens: tokens})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, email := range []string{"a@x.io", "b@x.io", "c@x.io"} {
+		_, err := users.Insert(ctx, &account{Email: email})
+		assert.NoError(t, err)
+	}
+	next := func(cs *db.ChangeStream) string {
+		select {
+		case ev := <-cs.C():
+			var a account
+			assert.NoError(t, ev.Decode(&a))
+			return a.Email
+		case <-ctx.Done():
+			t.Fatal("no change event")
+			return ""
+		}
+	}
+	assert.Equal(t, "a@x.io", next(cs))
+	assert.Equal(t, "b@x.io", next(cs))
+	assert.NoError(t, cs.Close())
+	assert.NoError(t, cs.Err())
+
+	// the token of a@x.io was saved once b@x.io was received, so b@x.io is
+	// delivered again
+	cs, err = m.Watch(ctx, db.WatchOptions{Collection: "users", FullDocument: true, Tokens: tokens})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cs.Close()
+	assert.Equal(t, "b@x.io", next(cs))
+	assert.Equal(t, "c@x.io", next(cs))
+}
@@ -0,0 +1,124 @@
+package example
+
+import (
+	"context"
+	"github.com/akikistyle/caplibgo/ratelimit"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+type fakeClock struct{ t time.Time }
+
+func (c *fakeClock) now() time.Time { return c.t }
+
+func allowN(t *testing.T, l ratelimit.Limiter, key string, n int) *ratelimit.Result {
+	var res *ratelimit.Result
+	for i := 0; i < n; i++ {
+		var err error
+		res, err = l.Allow(context.Background(), key)
+		assert.NoError(t, err)
+	}
+	return res
+}
+
+func Test_RateLimit(t *testing.T) {
+	s, r := newTestRedis(t)
+	clock := &fakeClock{t: time.Unix(1700000000, 0)}
+
+	tests := []struct {
+		name    string
+		limiter ratelimit.Limiter
+		advance func(d time.Duration)
+	}{
+		{"fixed window", ratelimit.NewFixedWindow(r, 3, time.Minute), s.FastForward},
+		{"sliding log", ratelimit.NewSlidingLog(r, 3, time.Minute, ratelimit.WithClock(clock.now)),
+			func(d time.Duration) { clock.t = clock.t.Add(d) }},
+		{"token bucket", ratelimit.NewTokenBucket(r, 3, 20*time.Second, ratelimit.WithClock(clock.now)),
+			func(d time.Duration) { clock.t = clock.t.Add(d) }},
+	}
+	for _, tt := range tests {
+		key := tt.name
+		res := allowN(t, tt.limiter, key, 3)
+		assert.True(t, res.Allowed, tt.name)
+		assert.Equal(t, 3, res.Limit, tt.name)
+		assert.Equal(t, 0, res.Remaining, tt.name)
+		assert.True(t, res.Reset > 0, tt.name)
+
+		res = allowN(t, tt.limiter, key, 1)
+		assert.False(t, res.Allowed, tt.name)
+		assert.True(t, res.RetryAfter > 0, tt.name)
+
+		tt.advance(time.Minute)
+		res = allowN(t, tt.limiter, key, 1)
+		assert.True(t, res.Allowed, tt.name)
+		assert.Equal(t, 2, res.Remaining, tt.name)
+	}
+
+	// the token bucket refills one token per interval
+	tb := ratelimit.NewTokenBucket(r, 2, 10*time.Second, ratelimit.WithClock(clock.now))
+	allowN(t, tb, "refill", 2)
+	res := allowN(t, tb, "refill", 1)
+	assert.False(t, res.Allowed)
+	assert.Equal(t, 10*time.Second, res.RetryAfter)
+	clock.t = clock.t.Add(10 * time.Second)
+	res = allowN(t, tb, "refill", 1)
+	assert.True(t, res.Allowed)
+	assert.Equal(t, 0, res.Remaining)
+}
+
+func Test_RateLimitMiddleware(t *testing.T) {
+	_, r := newTestRedis(t)
+	l := ratelimit.NewFixedWindow(r, 1, time.Minute)
+	h := ratelimit.Middleware(l, ratelimit.KeyByHeader("X-Api-Key"))(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+
+	do := func(key string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("X-Api-Key", key)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w
+	}
+
+	w := do("abc")
+	assert.Equal(t, http.StatusNoContent, w.Code)
+	assert.Equal(t, "1", w.Header().Get("RateLimit-Limit"))
+	assert.Equal(t, "0", w.Header().Get("RateLimit-Remaining"))
+	assert.Equal(t, "60", w.Header().Get("RateLimit-Reset"))
+
+	w = do("abc")
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.Equal(t, "60", w.Header().Get("Retry-After"))
+
+	// requests without a key are not limited
+	assert.Equal(t, http.StatusNoContent, do("").Code)
+	assert.Empty(t, do("").Header().Get("RateLimit-Limit"))
+}
+
+func Test_RateLimitSlidingLogReset(t *testing.T) {
+	_, r := newTestRedis(t)
+	clock := &fakeClock{t: time.Unix(1700000000, 0)}
+	l := ratelimit.NewSlidingLog(r, 3, time.Minute, ratelimit.WithClock(clock.now))
+
+	// spread the requests, so the key is at its limit with entries of
+	// different ages
+	for i := 0; i < 3; i++ {
+		allowN(t, l, "spread", 1)
+		clock.t = clock.t.Add(10 * time.Second)
+	}
+	res := allowN(t, l, "spread", 1)
+	assert.False(t, res.Allowed)
+	assert.Equal(t, 30*time.Second, res.RetryAfter)
+	assert.Equal(t, 50*time.Second, res.Reset)
+
+	// once Reset has passed the whole quota is back
+	clock.t = clock.t.Add(res.Reset)
+	res = allowN(t, l, "spread", 1)
+	assert.True(t, res.Allowed)
+	assert.Equal(t, 2, res.Remaining)
+	assert.Equal(t, time.Minute, res.Reset)
+}
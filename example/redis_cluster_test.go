@@ -0,0 +1,312 @@
+package example
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"github.com/akikistyle/caplibgo/db"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/stretchr/testify/assert"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeRedis is a minimal RESP server for the commands miniredis doesn't
+// speak, such as SENTINEL and ROLE. handle gets the command arguments and
+// returns a raw RESP reply.
+func fakeRedis(t *testing.T, handle func(args []string) string) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func(c net.Conn) {
+				defer c.Close()
+				rd := bufio.NewReader(c)
+				for {
+					args, err := readCommand(rd)
+					if err != nil {
+						return
+					}
+					if _, err := c.Write([]byte(handle(args))); err != nil {
+						return
+					}
+				}
+			}(c)
+		}
+	}()
+	return l.Addr().String()
+}
+
+func readCommand(rd *bufio.Reader) ([]string, error) {
+	line, err := rd.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(line[1:]))
+	if err != nil {
+		return nil, err
+	}
+	args := make([]string, n)
+	for i := range args {
+		if _, err := rd.ReadString('\n'); err != nil {
+			return nil, err
+		}
+		arg, err := rd.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		args[i] = strings.TrimSuffix(arg, "\r\n")
+	}
+	return args, nil
+}
+
+func bulk(s string) string {
+	return fmt.Sprintf("$%d\r\n%s\r\n", len(s), s)
+}
+
+// fakeMaster answers ROLE as a master and keeps SET/GET values in memory.
+func fakeMaster(t *testing.T) string {
+	var mu sync.Mutex
+	data := map[string]string{}
+	return fakeRedis(t, func(args []string) string {
+		mu.Lock()
+		defer mu.Unlock()
+		switch strings.ToUpper(args[0]) {
+		case "ROLE":
+			return "*3\r\n" + bulk("master") + ":0\r\n*0\r\n"
+		case "PING":
+			return "+PONG\r\n"
+		case "SELECT", "ASKING":
+			return "+OK\r\n"
+		case "SET":
+			data[args[1]] = args[2]
+			return "+OK\r\n"
+		case "GET":
+			if v, ok := data[args[1]]; ok {
+				return bulk(v)
+			}
+			return "$-1\r\n"
+		}
+		return "-ERR unknown command\r\n"
+	})
+}
+
+func Test_RedisSentinel(t *testing.T) {
+	masters := []string{fakeMaster(t), fakeMaster(t)}
+	var mu sync.Mutex
+	current := 0
+	sentinel := fakeRedis(t, func(args []string) string {
+		mu.Lock()
+		defer mu.Unlock()
+		if len(args) == 3 && args[1] == "get-master-addr-by-name" && args[2] == "mymaster" {
+			host, port, _ := net.SplitHostPort(masters[current])
+			return "*2\r\n" + bulk(host) + bulk(port)
+		}
+		return "*-1\r\n"
+	})
+	down := "127.0.0.1:1"
+
+	r, err := db.NewRedis(&db.DBOpts{
+		Addrs:      []string{down, sentinel},
+		MasterName: "mymaster",
+		Database:   "0",
+		Retry:      &db.RetryPolicy{MaxAttempts: 1},
+	})
+	assert.NoError(t, err)
+	defer r.Close()
+	assert.NoError(t, r.Set("k", "first", 0))
+
+	// fail over; with no idle connections kept every command dials again
+	// and must reach the new master
+	mu.Lock()
+	current = 1
+	mu.Unlock()
+	_, err = r.Get("k")
+	assert.Error(t, err)
+	assert.NoError(t, r.Set("k", "second", 0))
+	v, err := r.Get("k")
+	assert.NoError(t, err)
+	assert.Equal(t, "second", string(v))
+
+	_, err = db.NewRedis(&db.DBOpts{Addrs: []string{sentinel}, MasterName: "other", Retry: &db.RetryPolicy{MaxAttempts: 1}})
+	assert.Error(t, err)
+}
+
+func Test_RedisCluster(t *testing.T) {
+	node := fakeMaster(t)
+
+	// the seed claims every slot but redirects foo with MOVED and bar with
+	// ASK, the way a cluster does while slots are being resharded
+	var mu sync.Mutex
+	redirects := map[string]int{}
+	var seed string
+	seed = fakeRedis(t, func(args []string) string {
+		mu.Lock()
+		defer mu.Unlock()
+		switch strings.ToUpper(args[0]) {
+		case "CLUSTER":
+			host, port, _ := net.SplitHostPort(seed)
+			return "*1\r\n*3\r\n:0\r\n:16383\r\n*2\r\n" + bulk(host) + ":" + port + "\r\n"
+		case "PING":
+			return "+PONG\r\n"
+		}
+		switch args[1] {
+		case "foo":
+			redirects["MOVED"]++
+			return "-MOVED 12182 " + node + "\r\n"
+		case "bar":
+			redirects["ASK"]++
+			return "-ASK 5061 " + node + "\r\n"
+		}
+		return "-ERR unexpected key\r\n"
+	})
+
+	r, err := db.NewRedis(&db.DBOpts{Addrs: []string{seed}, Cluster: true, MaxIdle: 2, Retry: &db.RetryPolicy{MaxAttempts: 1}})
+	assert.NoError(t, err)
+	defer r.Close()
+
+	for _, key := range []string{"foo", "bar"} {
+		assert.NoError(t, r.Set(key, "v-"+key, 0))
+		v, err := r.Get(key)
+		assert.NoError(t, err)
+		assert.Equal(t, "v-"+key, string(v))
+	}
+	mu.Lock()
+	assert.True(t, redirects["MOVED"] >= 1)
+	assert.Equal(t, 2, redirects["ASK"])
+	mu.Unlock()
+
+	// pipelined commands are routed one by one
+	conn := r.DB.Get()
+	defer conn.Close()
+	assert.NoError(t, conn.Send("GET", "foo"))
+	assert.NoError(t, conn.Send("GET", "bar"))
+	assert.NoError(t, conn.Flush())
+	for _, want := range []string{"v-foo", "v-bar"} {
+		v, err := conn.Receive()
+		assert.NoError(t, err)
+		assert.Equal(t, want, string(v.([]byte)))
+	}
+}
+
+func Test_RedisClusterScan(t *testing.T) {
+	a, b := miniredis.RunT(t), miniredis.RunT(t)
+	var seed string
+	seed = fakeRedis(t, func(args []string) string {
+		switch strings.ToUpper(args[0]) {
+		case "CLUSTER":
+			return "*2\r\n" +
+				"*3\r\n:0\r\n:8191\r\n*2\r\n" + bulk(a.Host()) + ":" + a.Port() + "\r\n" +
+				"*3\r\n:8192\r\n:16383\r\n*2\r\n" + bulk(b.Host()) + ":" + b.Port() + "\r\n"
+		case "PING":
+			return "+PONG\r\n"
+		}
+		return "-ERR unexpected command\r\n"
+	})
+
+	want := map[string]bool{}
+	for i := 0; i < 10; i++ {
+		node := a
+		if i%2 == 1 {
+			node = b
+		}
+		key := fmt.Sprintf("user:%d", i)
+		node.Set(key, "x")
+		want[key] = true
+	}
+
+	r, err := db.NewRedis(&db.DBOpts{Addrs: []string{seed}, Cluster: true, MaxIdle: 2, Retry: &db.RetryPolicy{MaxAttempts: 1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	got := map[string]bool{}
+	it := r.Scan("user:*", 2)
+	for it.Next(context.Background()) {
+		assert.False(t, got[it.Val()], "%s seen twice", it.Val())
+		got[it.Val()] = true
+	}
+	assert.NoError(t, it.Err())
+	assert.Equal(t, want, got)
+}
+
+func Test_RedisClusterSubcommandKey(t *testing.T) {
+	// each node remembers which keys reached it; the key follows the
+	// subcommand for XGROUP, XINFO and OBJECT
+	var mu sync.Mutex
+	seen := map[string]map[string]bool{}
+	node := func(name string) string {
+		seen[name] = map[string]bool{}
+		return fakeRedis(t, func(args []string) string {
+			mu.Lock()
+			defer mu.Unlock()
+			switch strings.ToUpper(args[0]) {
+			case "GET":
+				seen[name][args[1]] = true
+			case "XGROUP", "XINFO", "OBJECT":
+				seen[name][args[2]] = true
+			}
+			return "+OK\r\n"
+		})
+	}
+	a, b := node("a"), node("b")
+	seed := fakeRedis(t, func(args []string) string {
+		switch strings.ToUpper(args[0]) {
+		case "CLUSTER":
+			ah, ap, _ := net.SplitHostPort(a)
+			bh, bp, _ := net.SplitHostPort(b)
+			return "*2\r\n" +
+				"*3\r\n:0\r\n:8191\r\n*2\r\n" + bulk(ah) + ":" + ap + "\r\n" +
+				"*3\r\n:8192\r\n:16383\r\n*2\r\n" + bulk(bh) + ":" + bp + "\r\n"
+		case "PING":
+			return "+PONG\r\n"
+		}
+		return "-ERR unexpected command\r\n"
+	})
+
+	r, err := db.NewRedis(&db.DBOpts{Addrs: []string{seed}, Cluster: true, MaxIdle: 2, Retry: &db.RetryPolicy{MaxAttempts: 1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	conn := r.DB.Get()
+	defer conn.Close()
+	for i := 0; i < 10; i++ {
+		key := fmt.Sprintf("stream:%d", i)
+		for _, cmd := range [][]interface{}{
+			{"XGROUP", "CREATE", key, "g", "$", "MKSTREAM"},
+			{"XGROUP", "SETID", key, "g", "0"},
+			{"XINFO", "STREAM", key},
+			{"XINFO", "GROUPS", key},
+			{"OBJECT", "ENCODING", key},
+		} {
+			_, err := conn.Do(cmd[0].(string), cmd[1:]...)
+			assert.NoError(t, err)
+		}
+		_, err := conn.Do("GET", key)
+		assert.NoError(t, err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	// every key was routed to the node GET chose for it, and both nodes got
+	// some keys
+	assert.NotEmpty(t, seen["a"])
+	assert.NotEmpty(t, seen["b"])
+	for key := range seen["a"] {
+		assert.False(t, seen["b"][key], "%s reached both nodes", key)
+	}
+}
@@ -0,0 +1,75 @@
+package example
+
+import (
+	"context"
+	"github.com/akikistyle/caplibgo/db"
+	"github.com/garyburd/redigo/redis"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func Test_RedisPipeline(t *testing.T) {
+	_, r := newTestRedis(t)
+	ctx := context.Background()
+	assert.NoError(t, r.Set("name", "ann", 0))
+
+	p := r.Pipeline()
+	incr := p.Do("INCR", "hits")
+	get := p.Do("GET", "name")
+	miss := p.Do("GET", "nope")
+	bad := p.Do("INCR", "name")
+	assert.Equal(t, 4, p.Len())
+	_, err := incr.Int64()
+	assert.Error(t, err, "reply read before Exec")
+
+	err = p.Exec(ctx)
+	_, ok := err.(*db.CommandError)
+	assert.True(t, ok, "first command error is returned")
+	n, err := incr.Int64()
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), n)
+	s, err := get.Text()
+	assert.NoError(t, err)
+	assert.Equal(t, "ann", s)
+	_, err = miss.Bytes()
+	assert.Equal(t, db.ErrCacheMiss, err)
+	assert.Error(t, bad.Err())
+	assert.Equal(t, 0, p.Len())
+}
+
+func Test_RedisTx(t *testing.T) {
+	_, r := newTestRedis(t)
+	ctx := context.Background()
+	assert.NoError(t, r.Set("counter", "10", 0))
+
+	attempts := 0
+	var res *db.Reply
+	err := r.Tx(ctx, []string{"counter"}, func(tx *db.Tx) error {
+		attempts++
+		if attempts == 1 {
+			// a concurrent writer aborts the first EXEC
+			if err := r.Set("counter", "20", 0); err != nil {
+				return err
+			}
+		}
+		n, err := redis.Int64(tx.Do("GET", "counter"))
+		if err != nil {
+			return err
+		}
+		res = tx.Queue("SET", "counter", n*2)
+		tx.Queue("INCR", "counter")
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 2, attempts)
+	assert.NoError(t, res.Err())
+	n, err := r.Incr("counter")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(42), n)
+
+	err = r.Tx(ctx, []string{"counter"}, func(tx *db.Tx) error {
+		tx.Queue("INCR", "counter")
+		return r.Set("counter", "0", 0)
+	})
+	assert.Equal(t, db.ErrTxConflict, err)
+}
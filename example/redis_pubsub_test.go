@@ -0,0 +1,224 @@
+package example
+
+import (
+	"context"
+	"errors"
+	"github.com/akikistyle/caplibgo/db"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/stretchr/testify/assert"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func Test_RedisPubSub(t *testing.T) {
+	s := miniredis.RunT(t)
+	r, err := db.NewRedis(&db.DBOpts{
+		Host:  s.Host(),
+		Port:  mustPort(t, s.Port()),
+		Retry: &db.RetryPolicy{MaxAttempts: 1, InitialBackoff: 10 * time.Millisecond, MaxBackoff: 10 * time.Millisecond},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	ctx := context.Background()
+
+	sub, err := r.Subscribe(ctx, "news")
+	assert.NoError(t, err)
+	psub, err := r.PSubscribe(ctx, "news.*")
+	assert.NoError(t, err)
+
+	_, err = r.Publish(ctx, "news", "hello")
+	assert.NoError(t, err)
+	_, err = r.Publish(ctx, "news.sport", "goal")
+	assert.NoError(t, err)
+	msg := <-sub.C()
+	assert.Equal(t, &db.Message{Channel: "news", Data: []byte("hello")}, msg)
+	msg = <-psub.C()
+	assert.Equal(t, &db.Message{Channel: "news.sport", Pattern: "news.*", Data: []byte("goal")}, msg)
+	assert.NoError(t, psub.Close())
+	_, ok := <-psub.C()
+	assert.False(t, ok)
+
+	// the subscription survives a server restart
+	s.Close()
+	assert.NoError(t, s.Restart())
+	deadline := time.After(5 * time.Second)
+	for received := false; !received; {
+		r.Publish(ctx, "news", "again")
+		select {
+		case msg := <-sub.C():
+			assert.Equal(t, "again", string(msg.Data))
+			received = true
+		case <-time.After(20 * time.Millisecond):
+		case <-deadline:
+			t.Fatal("no message after reconnect")
+		}
+	}
+	assert.NoError(t, sub.Close())
+}
+
+func Test_RedisStreamWorker(t *testing.T) {
+	_, r := newTestRedis(t)
+	ctx := context.Background()
+	for _, id := range []string{"1", "2", "3", "4", "5"} {
+		_, err := r.XAdd(ctx, "jobs", 100, map[string]interface{}{"job": id})
+		assert.NoError(t, err)
+	}
+
+	var (
+		mu      sync.Mutex
+		done    []string
+		failed  bool
+		running int
+		peak    int
+	)
+	wctx, cancel := context.WithCancel(ctx)
+	w := &db.StreamWorker{
+		Redis:       r,
+		Stream:      "jobs",
+		Group:       "workers",
+		Consumer:    "w1",
+		Concurrency: 2,
+		Block:       10 * time.Millisecond,
+		ClaimIdle:   50 * time.Millisecond,
+		Handler: func(ctx context.Context, msg db.XMessage) error {
+			mu.Lock()
+			running++
+			if running > peak {
+				peak = running
+			}
+			mu.Unlock()
+			time.Sleep(5 * time.Millisecond)
+
+			mu.Lock()
+			defer mu.Unlock()
+			running--
+			if msg.Values["job"] == "3" && !failed {
+				// fail once, the entry is claimed again later
+				failed = true
+				return errors.New("try again")
+			}
+			done = append(done, msg.Values["job"])
+			if len(done) == 5 {
+				cancel()
+			}
+			return nil
+		},
+	}
+	errc := make(chan error)
+	go func() { errc <- w.Run(wctx) }()
+	select {
+	case err := <-errc:
+		assert.Equal(t, context.Canceled, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("worker did not finish")
+	}
+
+	sort.Strings(done)
+	assert.Equal(t, []string{"1", "2", "3", "4", "5"}, done)
+	assert.Equal(t, 2, peak)
+	pending, err := r.XPending(ctx, "jobs", "workers", 10)
+	assert.NoError(t, err)
+	assert.Empty(t, pending)
+}
+
+func Test_RedisStreamWorkerSlowHandler(t *testing.T) {
+	_, r := newTestRedis(t)
+	ctx := context.Background()
+	_, err := r.XAdd(ctx, "jobs", 100, map[string]interface{}{"job": "slow"})
+	assert.NoError(t, err)
+
+	var calls int32
+	wctx, cancel := context.WithCancel(ctx)
+	w := &db.StreamWorker{
+		Redis:       r,
+		Stream:      "jobs",
+		Group:       "workers",
+		Consumer:    "w1",
+		Concurrency: 2,
+		Block:       5 * time.Millisecond,
+		ClaimIdle:   10 * time.Millisecond,
+		Handler: func(ctx context.Context, msg db.XMessage) error {
+			atomic.AddInt32(&calls, 1)
+			// outlasts ClaimIdle several times over
+			time.Sleep(100 * time.Millisecond)
+			cancel()
+			return nil
+		},
+	}
+	assert.Equal(t, context.Canceled, w.Run(wctx))
+	assert.Equal(t, int32(1), atomic.LoadInt32(&calls))
+}
+
+func Test_RedisStreamWorkerPanic(t *testing.T) {
+	_, r := newTestRedis(t)
+	ctx := context.Background()
+	_, err := r.XAdd(ctx, "jobs", 100, map[string]interface{}{"job": "boom"})
+	assert.NoError(t, err)
+
+	var calls int32
+	wctx, cancel := context.WithCancel(ctx)
+	w := &db.StreamWorker{
+		Redis:     r,
+		Stream:    "jobs",
+		Group:     "workers",
+		Consumer:  "w1",
+		Block:     5 * time.Millisecond,
+		ClaimIdle: 20 * time.Millisecond,
+		Handler: func(ctx context.Context, msg db.XMessage) error {
+			if atomic.AddInt32(&calls, 1) == 1 {
+				panic("first delivery")
+			}
+			cancel()
+			return nil
+		},
+	}
+	// the panic leaves the entry pending and frees the slot, so it is
+	// claimed and handled again
+	assert.Equal(t, context.Canceled, w.Run(wctx))
+	assert.Equal(t, int32(2), atomic.LoadInt32(&calls))
+	pending, err := r.XPending(ctx, "jobs", "workers", 10)
+	assert.NoError(t, err)
+	assert.Empty(t, pending)
+}
+
+func Test_RedisCloseEndsBlockedReaders(t *testing.T) {
+	_, r := newTestRedis(t)
+	ctx := context.Background()
+
+	sub, err := r.Subscribe(ctx, "news")
+	assert.NoError(t, err)
+	w := &db.StreamWorker{
+		Redis:    r,
+		Stream:   "jobs",
+		Group:    "workers",
+		Consumer: "w1",
+		Block:    time.Minute,
+		Handler:  func(ctx context.Context, msg db.XMessage) error { return nil },
+	}
+	errc := make(chan error, 1)
+	go func() { errc <- w.Run(ctx) }()
+	// let the worker start its blocking read
+	time.Sleep(50 * time.Millisecond)
+
+	cctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	assert.NoError(t, r.CloseContext(cctx))
+	select {
+	case err := <-errc:
+		assert.Equal(t, db.ErrPoolClosing, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("worker still reading after close")
+	}
+	select {
+	case _, ok := <-sub.C():
+		assert.False(t, ok)
+	case <-time.After(5 * time.Second):
+		t.Fatal("subscription still open after close")
+	}
+	assert.NoError(t, sub.Close())
+}
@@ -0,0 +1,55 @@
+package example
+
+import (
+	"context"
+	"github.com/akikistyle/caplibgo/db"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/garyburd/redigo/redis"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+var compareAndDelete = db.NewScript(1, `
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("DEL", KEYS[1])
+end
+return 0`)
+
+func Test_RedisScript(t *testing.T) {
+	s := miniredis.RunT(t)
+	ctx := context.Background()
+	r := &db.Redis{Opt: &db.DBOpts{Host: s.Host(), Port: mustPort(t, s.Port()), MaxIdle: 2}}
+	assert.NoError(t, r.RegisterScript(ctx, compareAndDelete))
+	assert.NoError(t, r.Connect())
+	defer r.Close()
+
+	// preloaded at Connect, so EVALSHA works straight away
+	conn := r.DB.Get()
+	defer conn.Close()
+	exists, err := redis.Ints(conn.Do("SCRIPT", "EXISTS", compareAndDelete.Hash()))
+	assert.NoError(t, err)
+	assert.Equal(t, []int{1}, exists)
+
+	assert.NoError(t, r.Set("lock", "token-a", 0))
+	n, err := redis.Int64(compareAndDelete.Run(ctx, r, []string{"lock"}, "token-b"))
+	assert.NoError(t, err)
+	assert.Equal(t, int64(0), n)
+	n, err = redis.Int64(compareAndDelete.Run(ctx, r, []string{"lock"}, "token-a"))
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), n)
+
+	// falls back to EVAL once the script cache is gone
+	s.FlushAll()
+	_, err = conn.Do("SCRIPT", "FLUSH")
+	assert.NoError(t, err)
+	n, err = redis.Int64(compareAndDelete.Run(ctx, r, []string{"lock"}, "token-a"))
+	assert.NoError(t, err)
+	assert.Equal(t, int64(0), n)
+
+	_, err = compareAndDelete.Run(ctx, r, nil)
+	assert.Error(t, err)
+
+	bad := &db.Redis{Opt: r.Opt}
+	assert.NoError(t, bad.RegisterScript(ctx, db.NewScript(0, "this is not lua")))
+	assert.Error(t, bad.Connect())
+}
@@ -0,0 +1,227 @@
+package example
+
+import (
+	"context"
+	"errors"
+	"github.com/akikistyle/caplibgo/db"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/stretchr/testify/assert"
+	"sort"
+	"testing"
+	"time"
+)
+
+func newTestRedis(t *testing.T) (*miniredis.Miniredis, *db.Redis) {
+	s := miniredis.RunT(t)
+	r, err := db.NewRedis(&db.DBOpts{Host: s.Host(), Port: mustPort(t, s.Port()), Database: "0", MaxIdle: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(r.Close)
+	return s, r
+}
+
+type user struct {
+	Name  string `redis:"name"`
+	Email string `redis:"email"`
+	Age   int    `redis:"age"`
+}
+
+func Test_RedisCommands(t *testing.T) {
+	s, r := newTestRedis(t)
+	ctx := context.Background()
+
+	// hashes
+	assert.NoError(t, r.HSetStruct(ctx, "user:1", &user{Name: "ann", Email: "ann@example.com", Age: 30}))
+	var u user
+	assert.NoError(t, r.HGetAll(ctx, "user:1", &u))
+	assert.Equal(t, user{Name: "ann", Email: "ann@example.com", Age: 30}, u)
+	n, err := r.HIncrBy(ctx, "user:1", "age", 1)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(31), n)
+	assert.Equal(t, db.ErrCacheMiss, r.HGetAll(ctx, "user:2", &u))
+	_, err = r.HIncrBy(ctx, "user:1", "name", 1)
+	_, ok := err.(*db.CommandError)
+	assert.True(t, ok)
+
+	// lists
+	_, err = r.RPush(ctx, "jobs", "a", "b", "c")
+	assert.NoError(t, err)
+	v, err := r.LPop(ctx, "jobs")
+	assert.NoError(t, err)
+	assert.Equal(t, "a", string(v))
+	vals, err := r.LRange(ctx, "jobs", 0, -1)
+	assert.NoError(t, err)
+	assert.Equal(t, [][]byte{[]byte("b"), []byte("c")}, vals)
+
+	// sets
+	_, err = r.SAdd(ctx, "tags", "go", "redis")
+	assert.NoError(t, err)
+	ok, err = r.SIsMember(ctx, "tags", "go")
+	assert.NoError(t, err)
+	assert.True(t, ok)
+
+	// sorted sets
+	_, err = r.ZAdd(ctx, "scores", db.Z{Member: "ann", Score: 3}, db.Z{Member: "bob", Score: 1.5})
+	assert.NoError(t, err)
+	zs, err := r.ZRangeWithScores(ctx, "scores", 0, -1)
+	assert.NoError(t, err)
+	assert.Equal(t, []db.Z{{Member: "bob", Score: 1.5}, {Member: "ann", Score: 3}}, zs)
+	zs, err = r.ZRangeByScore(ctx, "scores", "(2", "+inf", 0, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, []db.Z{{Member: "ann", Score: 3}}, zs)
+
+	// strings and expiry
+	ok, err = r.SetNX(ctx, "lock", "1", time.Minute)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	ok, err = r.SetNX(ctx, "lock", "2", time.Minute)
+	assert.NoError(t, err)
+	assert.False(t, ok)
+	ttl, err := r.TTL(ctx, "lock")
+	assert.NoError(t, err)
+	assert.Equal(t, time.Minute, ttl)
+	ok, err = r.Persist(ctx, "lock")
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	ttl, err = r.TTL(ctx, "lock")
+	assert.NoError(t, err)
+	assert.Equal(t, db.NoExpiry, ttl)
+	_, err = r.TTL(ctx, "missing")
+	assert.Equal(t, db.ErrCacheMiss, err)
+
+	assert.NoError(t, r.MSet(ctx, map[string]interface{}{"a": 1, "b": 2}))
+	vals, err = r.MGet(ctx, "a", "missing", "b")
+	assert.NoError(t, err)
+	assert.Equal(t, [][]byte{[]byte("1"), nil, []byte("2")}, vals)
+	old, err := r.GetSet(ctx, "a", 10)
+	assert.NoError(t, err)
+	assert.Equal(t, "1", string(old))
+
+	ok, err = r.Expire(ctx, "a", time.Second)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	s.FastForward(2 * time.Second)
+	_, err = r.Get("a")
+	assert.Equal(t, db.ErrCacheMiss, err)
+
+	// context
+	cctx, cancel := context.WithCancel(ctx)
+	cancel()
+	_, err = r.LLen(cctx, "jobs")
+	assert.Error(t, err)
+}
+
+func Test_RedisScan(t *testing.T) {
+	_, r := newTestRedis(t)
+	ctx := context.Background()
+
+	want := []string{}
+	for _, k := range []string{"user:1", "user:2", "user:3", "order:1"} {
+		assert.NoError(t, r.Set(k, "x", 0))
+		if k != "order:1" {
+			want = append(want, k)
+		}
+	}
+
+	var got []string
+	it := r.Scan("user:*", 1)
+	for it.Next(ctx) {
+		got = append(got, it.Val())
+	}
+	assert.NoError(t, it.Err())
+	sort.Strings(got)
+	assert.Equal(t, want, got)
+
+	_, err := r.HSet(ctx, "h", "f1", "v1")
+	assert.NoError(t, err)
+	it = r.HScan("h", "", 10)
+	got = nil
+	for it.Next(ctx) {
+		got = append(got, it.Val())
+	}
+	assert.NoError(t, it.Err())
+	assert.Equal(t, []string{"f1", "v1"}, got)
+}
+
+func Test_RedisSet(t *testing.T) {
+	s, r := newTestRedis(t)
+
+	assert.NoError(t, r.Set("k", "v1", 60))
+	assert.Equal(t, time.Minute, s.TTL("k"))
+
+	assert.Equal(t, db.ErrNotSet, r.Set("k", "v2", 0, db.SetIfNotExists()))
+	assert.NoError(t, r.Set("k", "v3", 0, db.SetIfExists(), db.SetKeepTTL()))
+	assert.Equal(t, time.Minute, s.TTL("k"))
+	v, err := r.Get("k")
+	assert.NoError(t, err)
+	assert.Equal(t, "v3", string(v))
+
+	assert.Equal(t, db.ErrNotSet, r.Set("other", "v", 0, db.SetIfExists()))
+	assert.NoError(t, r.Set("other", "v", 10, db.SetExpiry(1500*time.Millisecond)))
+	assert.Equal(t, 1500*time.Millisecond, s.TTL("other"))
+
+	ok, err := r.IsExist("other")
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	assert.NoError(t, r.Delete("other"))
+	ok, err = r.IsExist("other")
+	assert.NoError(t, err)
+	assert.False(t, ok)
+	_, err = r.Get("other")
+	assert.Equal(t, db.ErrCacheMiss, err)
+
+	s.Close()
+	_, err = r.IsExist("k")
+	assert.Error(t, err)
+}
+
+func Test_RedisCloseContext(t *testing.T) {
+	_, r := newTestRedis(t)
+	ctx := context.Background()
+	assert.NoError(t, r.Ping(ctx))
+
+	held := r.DB.Get()
+	assert.NoError(t, held.Err())
+	done := make(chan error)
+	go func() {
+		cctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+		defer cancel()
+		done <- r.CloseContext(cctx)
+	}()
+
+	// new work is refused while the held connection drains
+	assert.Eventually(t, func() bool {
+		_, err := r.Get("k")
+		return errors.Is(err, db.ErrPoolClosing)
+	}, time.Second, 10*time.Millisecond)
+	conn := r.DB.Get()
+	assert.ErrorIs(t, conn.Err(), db.ErrPoolClosing)
+	conn.Close()
+	_, err := r.Do(ctx, "PING")
+	assert.ErrorIs(t, err, db.ErrPoolClosing)
+
+	select {
+	case err := <-done:
+		t.Fatalf("CloseContext returned with a connection checked out: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	held.Close()
+	assert.NoError(t, <-done)
+}
+
+func Test_Millis(t *testing.T) {
+	assert.Equal(t, int64(1), db.Millis(time.Microsecond))
+	assert.Equal(t, int64(2), db.Millis(1500*time.Microsecond))
+	assert.Equal(t, int64(1000), db.Millis(time.Second))
+	assert.Equal(t, int64(0), db.Millis(0))
+	assert.Equal(t, int64(-1), db.Millis(-time.Millisecond))
+
+	s, r := newTestRedis(t)
+	ctx := context.Background()
+	ok, err := r.SetNX(ctx, "k", "v", 500*time.Microsecond)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	assert.True(t, s.Exists("k"), "a sub-millisecond ttl must not expire the key at once")
+	assert.Equal(t, time.Millisecond, s.TTL("k"))
+}
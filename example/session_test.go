@@ -0,0 +1,77 @@
+package example
+
+import (
+	"github.com/akikistyle/caplibgo/session"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func Test_Session(t *testing.T) {
+	s, r := newTestRedis(t)
+	store, err := session.NewStore(r, session.Options{Secret: []byte("0123456789abcdef0123456789abcdef"), TTL: time.Hour})
+	assert.NoError(t, err)
+	_, err = session.NewStore(r, session.Options{})
+	assert.Error(t, err)
+
+	h := store.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sess := session.FromContext(r.Context())
+		switch r.URL.Path {
+		case "/login":
+			assert.NoError(t, sess.Regenerate())
+			sess.Set("user", "ann")
+		case "/logout":
+			sess.Destroy()
+		}
+		w.Write([]byte(sess.Get("user")))
+	}))
+	do := func(path string, c *http.Cookie) (*httptest.ResponseRecorder, *http.Cookie) {
+		req := httptest.NewRequest("GET", path, nil)
+		if c != nil {
+			req.AddCookie(c)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		cookies := w.Result().Cookies()
+		if len(cookies) == 0 {
+			return w, nil
+		}
+		return w, cookies[0]
+	}
+
+	// an untouched new session is not stored
+	_, c := do("/", nil)
+	assert.Nil(t, c)
+
+	_, first := do("/login", nil)
+	assert.NotNil(t, first)
+	assert.True(t, first.HttpOnly)
+	w, _ := do("/", first)
+	assert.Equal(t, "ann", w.Body.String())
+
+	// logging in again regenerates the ID and drops the old session
+	_, second := do("/login", first)
+	assert.NotEqual(t, first.Value, second.Value)
+	w, _ = do("/", first)
+	assert.Equal(t, "", w.Body.String())
+
+	// every request slides the expiry
+	s.FastForward(50 * time.Minute)
+	do("/", second)
+	s.FastForward(50 * time.Minute)
+	w, _ = do("/", second)
+	assert.Equal(t, "ann", w.Body.String())
+
+	// a tampered cookie is a new session
+	forged := *second
+	forged.Value = forged.Value[:len(forged.Value)-2] + "xx"
+	w, _ = do("/", &forged)
+	assert.Equal(t, "", w.Body.String())
+
+	_, c = do("/logout", second)
+	assert.Equal(t, -1, c.MaxAge)
+	w, _ = do("/", second)
+	assert.Equal(t, "", w.Body.String())
+}
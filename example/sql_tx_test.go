@@ -0,0 +1,88 @@
+package example
+
+import (
+	"context"
+	"database/sql"
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/akikistyle/caplibgo/db"
+	mysqldrv "github.com/go-sql-driver/mysql"
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func newMockDB(t *testing.T, driver string) (*sqlx.DB, sqlmock.Sqlmock) {
+	conn, mock, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return sqlx.NewDb(conn, driver), mock
+}
+
+func Test_PostgresWithTx(t *testing.T) {
+	sqlDB, mock := newMockDB(t, "postgres")
+	p := &db.PostgresDB{DB: sqlDB, Opt: &db.DBOpts{}}
+	ctx := context.Background()
+	transfer := func(tx *sqlx.Tx) error {
+		if _, err := tx.Exec("UPDATE accounts SET balance = balance - 10 WHERE id = 1"); err != nil {
+			return err
+		}
+		// a failed audit insert must not abort the transfer
+		audit := db.Savepoint(ctx, tx, func(tx *sqlx.Tx) error {
+			_, err := tx.Exec("INSERT INTO audit VALUES (1)")
+			return err
+		})
+		assert.Error(t, audit)
+		return nil
+	}
+
+	// serialization failure on the first attempt, then success
+	mock.ExpectBegin()
+	mock.ExpectExec("UPDATE accounts SET balance = balance - 10 WHERE id = 1").WillReturnError(&pq.Error{Code: "40001"})
+	mock.ExpectRollback()
+	mock.ExpectBegin()
+	mock.ExpectExec("UPDATE accounts SET balance = balance - 10 WHERE id = 1").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("SAVEPOINT sp_1").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("INSERT INTO audit VALUES (1)").WillReturnError(errors.New("no audit table"))
+	mock.ExpectExec("ROLLBACK TO SAVEPOINT sp_1").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectCommit()
+	assert.NoError(t, p.WithTx(ctx, nil, transfer))
+	assert.NoError(t, mock.ExpectationsWereMet())
+
+	// other errors are returned without retrying
+	failed := errors.New("insufficient funds")
+	mock.ExpectBegin()
+	mock.ExpectRollback()
+	err := p.WithTx(ctx, &sql.TxOptions{Isolation: sql.LevelSerializable}, func(tx *sqlx.Tx) error { return failed })
+	assert.Equal(t, failed, err)
+	assert.NoError(t, mock.ExpectationsWereMet())
+
+	// panics roll back and propagate
+	mock.ExpectBegin()
+	mock.ExpectRollback()
+	assert.Panics(t, func() {
+		p.WithTx(ctx, nil, func(tx *sqlx.Tx) error { panic("boom") })
+	})
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func Test_MysqlWithTx(t *testing.T) {
+	sqlDB, mock := newMockDB(t, "mysql")
+	m := &db.MysqlDB{DB: sqlDB, Opt: &db.DBOpts{}}
+	deadlock := &mysqldrv.MySQLError{Number: 1213, Message: "Deadlock found"}
+
+	for i := 0; i < db.SQLTxMaxAttempts; i++ {
+		mock.ExpectBegin()
+		mock.ExpectExec("DELETE FROM jobs WHERE id = 1").WillReturnError(deadlock)
+		mock.ExpectRollback()
+	}
+	err := m.WithTx(context.Background(), nil, func(tx *sqlx.Tx) error {
+		_, err := tx.Exec("DELETE FROM jobs WHERE id = 1")
+		return err
+	})
+	assert.Equal(t, deadlock, err)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
@@ -0,0 +1,111 @@
+package example
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"github.com/akikistyle/caplibgo/db"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// newTestCA writes a CA certificate to dir and returns a server certificate
+// for localhost and 127.0.0.1 signed by it.
+func newTestCA(t *testing.T, dir string) (caFile string, server tls.Certificate) {
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	caTmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "caplibgo test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTmpl, caTmpl, &caKey.PublicKey, caKey)
+	assert.NoError(t, err)
+	caCert, err := x509.ParseCertificate(caDER)
+	assert.NoError(t, err)
+
+	srvKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	srvTmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	srvDER, err := x509.CreateCertificate(rand.Reader, srvTmpl, caCert, &srvKey.PublicKey, caKey)
+	assert.NoError(t, err)
+
+	caFile = filepath.Join(dir, "ca.pem")
+	assert.NoError(t, ioutil.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: caDER}), 0600))
+	return caFile, tls.Certificate{Certificate: [][]byte{srvDER}, PrivateKey: srvKey}
+}
+
+func Test_RedisTLS(t *testing.T) {
+	caFile, cert := newTestCA(t, t.TempDir())
+	s, err := miniredis.RunTLS(&tls.Config{Certificates: []tls.Certificate{cert}})
+	assert.NoError(t, err)
+	defer s.Close()
+
+	tests := []struct {
+		name    string
+		tls     *db.TLSOpts
+		wantErr bool
+	}{
+		{name: "Verify full", tls: &db.TLSOpts{CAFile: caFile}},
+		{name: "Verify full wrong name", tls: &db.TLSOpts{CAFile: caFile, ServerName: "cache.example"}, wantErr: true},
+		{name: "Verify CA wrong name", tls: &db.TLSOpts{CAFile: caFile, ServerName: "cache.example", Verify: db.TLSVerifyCA}},
+		{name: "Verify CA unknown CA", tls: &db.TLSOpts{Verify: db.TLSVerifyCA}, wantErr: true},
+		{name: "Skip verify", tls: &db.TLSOpts{Verify: db.TLSSkipVerify}},
+		{name: "Half client cert", tls: &db.TLSOpts{CertFile: caFile}, wantErr: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r, err := db.NewRedis(&db.DBOpts{
+				Host:     "127.0.0.1",
+				Port:     mustPort(t, s.Port()),
+				Database: "0",
+				TLS:      test.tls,
+				Retry:    &db.RetryPolicy{MaxAttempts: 1},
+			})
+			if test.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			defer r.Close()
+			assert.NoError(t, r.Set("greeting", "hello", 0))
+			v, err := r.Get("greeting")
+			assert.NoError(t, err)
+			assert.Equal(t, "hello", string(v))
+		})
+	}
+}
+
+func Test_PostgresTLSSource(t *testing.T) {
+	p := &db.PostgresDB{Opt: &db.DBOpts{
+		Host: "pg", Port: 5432, User: "u", Password: "p", Database: "d",
+		TLS: &db.TLSOpts{CAFile: "/etc/ca.pem", CertFile: "/etc/c.pem", KeyFile: "/etc/k.pem", Verify: db.TLSVerifyCA},
+	}}
+	assert.Equal(t, "postgres://u:p@pg:5432/d?sslcert=%2Fetc%2Fc.pem&sslkey=%2Fetc%2Fk.pem&sslmode=verify-ca&sslrootcert=%2Fetc%2Fca.pem", p.DBSource())
+
+	m := &db.MysqlDB{Opt: &db.DBOpts{Host: "my", Port: 3306, User: "u", Password: "p", Database: "d", TLS: &db.TLSOpts{}}}
+	assert.Equal(t, "u:p@tcp(my:3306)/d?charset=utf8&parseTime=true&tls=caplibgo-my-3306", m.DBSource())
+}
@@ -0,0 +1,265 @@
+// Package lock implements distributed locks on top of db.Redis.
+//
+//	locker := lock.New(r)
+//	l, err := locker.Wait(ctx, "jobs:cleanup", 30*time.Second)
+//	if err != nil { ... }
+//	defer l.Release(context.Background())
+//
+// A lock is a key holding a random token. Only the holder of the token can
+// extend or release it, so a lock that expired and was taken by someone else
+// is never released by mistake.
+package lock
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"github.com/akikistyle/caplibgo/db"
+	"github.com/garyburd/redigo/redis"
+	"github.com/pkg/errors"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrNotAcquired is returned by Acquire when the lock is held by someone
+	// else.
+	ErrNotAcquired = errors.New("lock not acquired")
+	// ErrLockLost is returned by Extend and Release when the lock expired or
+	// was taken over.
+	ErrLockLost = errors.New("lock no longer held")
+)
+
+// DefaultWaitPolicy is how Wait backs off between attempts unless WithBackoff
+// is given. MaxAttempts is ignored; Wait tries until its context is done.
+var DefaultWaitPolicy = db.RetryPolicy{
+	InitialBackoff: 50 * time.Millisecond,
+	MaxBackoff:     time.Second,
+	Multiplier:     2,
+	Jitter:         0.2,
+}
+
+// clockDrift is the share of the ttl a Redlock lease gives up to allow for
+// clock drift between the Redis servers.
+const clockDrift = 0.01
+
+var (
+	releaseScript = db.NewScript(1, `
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("DEL", KEYS[1])
+end
+return 0`)
+
+	extendScript = db.NewScript(1, `
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("PEXPIRE", KEYS[1], ARGV[2])
+end
+return 0`)
+)
+
+// Locker hands out locks held on one Redis, or on a majority of several
+// independent Redis servers in Redlock mode.
+type Locker struct {
+	clients []*db.Redis
+	prefix  string
+	backoff *db.RetryPolicy
+}
+
+// Option configures a Locker.
+type Option func(*Locker)
+
+// WithPrefix puts prefix in front of every lock key.
+func WithPrefix(prefix string) Option {
+	return func(l *Locker) { l.prefix = prefix }
+}
+
+// WithBackoff sets how Wait backs off between attempts.
+func WithBackoff(p *db.RetryPolicy) Option {
+	return func(l *Locker) { l.backoff = p }
+}
+
+// New returns a Locker keeping its locks on r.
+func New(r *db.Redis, opts ...Option) *Locker {
+	return NewRedlock([]*db.Redis{r}, opts...)
+}
+
+// NewRedlock returns a Locker using the Redlock algorithm: a lock is held
+// once it is set on a majority of clients within its ttl. The clients must be
+// independent servers, not replicas of each other.
+func NewRedlock(clients []*db.Redis, opts ...Option) *Locker {
+	l := &Locker{clients: clients, backoff: &DefaultWaitPolicy}
+	for _, opt := range opts {
+		opt(l)
+	}
+	return l
+}
+
+func (l *Locker) quorum() int {
+	return len(l.clients)/2 + 1
+}
+
+// Acquire tries once to take the lock on key for ttl. It returns
+// ErrNotAcquired if the lock is held by someone else.
+func (l *Locker) Acquire(ctx context.Context, key string, ttl time.Duration) (*Lock, error) {
+	token, err := newToken()
+	if err != nil {
+		return nil, err
+	}
+	lk := &Lock{Key: l.prefix + key, token: token, locker: l}
+
+	start := time.Now()
+	n, err := l.each(ctx, func(ctx context.Context, r *db.Redis) (bool, error) {
+		return r.SetNX(ctx, lk.Key, token, ttl)
+	})
+	validity := ttl - time.Since(start) - l.drift(ttl)
+	if n >= l.quorum() && validity > 0 {
+		lk.setExpiry(start.Add(validity))
+		return lk, nil
+	}
+
+	// give back whatever part of the lock we did get
+	l.each(context.Background(), lk.release)
+	if err != nil && n < l.quorum() {
+		return nil, err
+	}
+	return nil, ErrNotAcquired
+}
+
+// Wait blocks until the lock on key is acquired or ctx is done, backing off
+// between attempts.
+func (l *Locker) Wait(ctx context.Context, key string, ttl time.Duration) (*Lock, error) {
+	for attempt := 1; ; attempt++ {
+		lk, err := l.Acquire(ctx, key, ttl)
+		if err != ErrNotAcquired {
+			return lk, err
+		}
+		t := time.NewTimer(l.backoff.Backoff(attempt))
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			t.Stop()
+			return nil, errors.Wrap(ctx.Err(), ErrNotAcquired.Error())
+		}
+	}
+}
+
+// drift is only accounted for in Redlock mode; a single server has one clock.
+func (l *Locker) drift(ttl time.Duration) time.Duration {
+	if len(l.clients) == 1 {
+		return 0
+	}
+	return time.Duration(float64(ttl)*clockDrift) + 2*time.Millisecond
+}
+
+// each runs fn on every client concurrently and counts the ones that
+// reported true. err is the first failure, if any.
+func (l *Locker) each(ctx context.Context, fn func(ctx context.Context, r *db.Redis) (bool, error)) (int, error) {
+	if len(l.clients) == 1 {
+		ok, err := fn(ctx, l.clients[0])
+		if ok {
+			return 1, err
+		}
+		return 0, err
+	}
+
+	var (
+		wg    sync.WaitGroup
+		mu    sync.Mutex
+		n     int
+		first error
+	)
+	for _, r := range l.clients {
+		wg.Add(1)
+		go func(r *db.Redis) {
+			defer wg.Done()
+			ok, err := fn(ctx, r)
+			mu.Lock()
+			defer mu.Unlock()
+			if ok {
+				n++
+			}
+			if err != nil && first == nil {
+				first = err
+			}
+		}(r)
+	}
+	wg.Wait()
+	return n, first
+}
+
+// Lock is a held lock. It is safe for concurrent use.
+type Lock struct {
+	Key string
+
+	token  string
+	locker *Locker
+
+	mu     sync.Mutex
+	expiry time.Time
+}
+
+// Token returns the random value identifying this holder.
+func (lk *Lock) Token() string {
+	return lk.token
+}
+
+// Validity returns how long the lock is still known to be held.
+func (lk *Lock) Validity() time.Duration {
+	lk.mu.Lock()
+	defer lk.mu.Unlock()
+	if d := time.Until(lk.expiry); d > 0 {
+		return d
+	}
+	return 0
+}
+
+func (lk *Lock) setExpiry(t time.Time) {
+	lk.mu.Lock()
+	lk.expiry = t
+	lk.mu.Unlock()
+}
+
+// Extend resets the ttl of the lease to ttl. It returns ErrLockLost if the
+// lock is no longer held.
+func (lk *Lock) Extend(ctx context.Context, ttl time.Duration) error {
+	ms := db.Millis(ttl)
+	start := time.Now()
+	n, err := lk.locker.each(ctx, func(ctx context.Context, r *db.Redis) (bool, error) {
+		return redis.Bool(extendScript.Run(ctx, r, []string{lk.Key}, lk.token, ms))
+	})
+	validity := ttl - time.Since(start) - lk.locker.drift(ttl)
+	if n >= lk.locker.quorum() && validity > 0 {
+		lk.setExpiry(start.Add(validity))
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return ErrLockLost
+}
+
+// Release gives the lock back. It returns ErrLockLost if the lock had
+// already expired or was taken over.
+func (lk *Lock) Release(ctx context.Context) error {
+	n, err := lk.locker.each(ctx, lk.release)
+	lk.setExpiry(time.Time{})
+	if err != nil {
+		return err
+	}
+	if n < lk.locker.quorum() {
+		return ErrLockLost
+	}
+	return nil
+}
+
+func (lk *Lock) release(ctx context.Context, r *db.Redis) (bool, error) {
+	return redis.Bool(releaseScript.Run(ctx, r, []string{lk.Key}, lk.token))
+}
+
+func newToken() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", errors.Wrap(err, "can not generate lock token")
+	}
+	return hex.EncodeToString(b), nil
+}
@@ -0,0 +1,67 @@
+package ratelimit
+
+import (
+	"github.com/sirupsen/logrus"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// KeyFunc picks the rate limit key of a request. An empty key skips the
+// limiter.
+type KeyFunc func(r *http.Request) string
+
+// KeyByIP limits by client IP, taken from the connection's remote address.
+func KeyByIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// KeyByHeader limits by the value of a request header such as an API key.
+func KeyByHeader(name string) KeyFunc {
+	return func(r *http.Request) string {
+		return r.Header.Get(name)
+	}
+}
+
+// Middleware limits requests with l and sets the RateLimit-Limit,
+// RateLimit-Remaining and RateLimit-Reset headers. Rejected requests get a
+// 429 with Retry-After. If Redis can not be reached the request is let
+// through and the error is logged.
+func Middleware(l Limiter, key KeyFunc) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			k := key(r)
+			if k == "" {
+				next.ServeHTTP(w, r)
+				return
+			}
+			res, err := l.Allow(r.Context(), k)
+			if err != nil {
+				logrus.WithError(err).WithField("key", k).Error("rate limit check failed")
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			h := w.Header()
+			h.Set("RateLimit-Limit", strconv.Itoa(res.Limit))
+			h.Set("RateLimit-Remaining", strconv.Itoa(res.Remaining))
+			h.Set("RateLimit-Reset", seconds(res.Reset))
+			if !res.Allowed {
+				h.Set("Retry-After", seconds(res.RetryAfter))
+				http.Error(w, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// seconds rounds d up to whole seconds, as the headers require.
+func seconds(d time.Duration) string {
+	return strconv.FormatInt(int64((d+time.Second-1)/time.Second), 10)
+}
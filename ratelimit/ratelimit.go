@@ -0,0 +1,233 @@
+// Package ratelimit implements rate limiters shared across replicas through
+// db.Redis. Every limiter runs a single Lua script per call, so concurrent
+// requests for the same key can not race each other.
+package ratelimit
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"github.com/akikistyle/caplibgo/db"
+	"github.com/garyburd/redigo/redis"
+	"github.com/pkg/errors"
+	"time"
+)
+
+// Result is the outcome of one Allow call.
+type Result struct {
+	Allowed   bool
+	Limit     int
+	Remaining int
+	// Reset is the time until the full quota is available again.
+	Reset time.Duration
+	// RetryAfter is the time until the next request would be allowed. It is
+	// zero when the request was allowed.
+	RetryAfter time.Duration
+}
+
+// Limiter decides whether a request for key is allowed and counts it if so.
+type Limiter interface {
+	Allow(ctx context.Context, key string) (*Result, error)
+}
+
+// Option configures a limiter.
+type Option func(*limiter)
+
+// WithPrefix sets the prefix of the Redis keys, "ratelimit:" by default.
+func WithPrefix(prefix string) Option {
+	return func(l *limiter) { l.prefix = prefix }
+}
+
+// WithClock replaces time.Now. The sliding log and token bucket limiters
+// pass the time to Redis, so replicas should have synchronised clocks.
+func WithClock(now func() time.Time) Option {
+	return func(l *limiter) { l.now = now }
+}
+
+type limiter struct {
+	r      *db.Redis
+	prefix string
+	now    func() time.Time
+}
+
+func newLimiter(r *db.Redis, opts []Option) limiter {
+	l := limiter{r: r, prefix: "ratelimit:", now: time.Now}
+	for _, opt := range opts {
+		opt(&l)
+	}
+	return l
+}
+
+func (l *limiter) nowMs() int64 {
+	return l.now().UnixNano() / int64(time.Millisecond)
+}
+
+// run runs script and returns its integer replies.
+func (l *limiter) run(ctx context.Context, script *db.Script, key string, args ...interface{}) ([]int64, error) {
+	vals, err := redis.Int64s(script.Run(ctx, l.r, []string{l.prefix + key}, args...))
+	if err != nil {
+		return nil, errors.Wrap(err, "rate limit can not be checked")
+	}
+	return vals, nil
+}
+
+func fromMs(n int64) time.Duration {
+	if n < 0 {
+		return 0
+	}
+	return time.Duration(n) * time.Millisecond
+}
+
+var fixedWindowScript = db.NewScript(1, `
+local n = redis.call("INCR", KEYS[1])
+if n == 1 then
+	redis.call("PEXPIRE", KEYS[1], ARGV[1])
+end
+return {n, redis.call("PTTL", KEYS[1])}`)
+
+// FixedWindow allows Limit requests per Window. The window starts with the
+// first request for a key. It is the cheapest limiter but allows bursts of up
+// to twice the limit around window boundaries.
+type FixedWindow struct {
+	limiter
+	Limit  int
+	Window time.Duration
+}
+
+func NewFixedWindow(r *db.Redis, limit int, window time.Duration, opts ...Option) *FixedWindow {
+	return &FixedWindow{limiter: newLimiter(r, opts), Limit: limit, Window: window}
+}
+
+func (l *FixedWindow) Allow(ctx context.Context, key string) (*Result, error) {
+	vals, err := l.run(ctx, fixedWindowScript, key, db.Millis(l.Window))
+	if err != nil {
+		return nil, err
+	}
+	n, reset := int(vals[0]), fromMs(vals[1])
+	res := &Result{Allowed: n <= l.Limit, Limit: l.Limit, Remaining: l.Limit - n, Reset: reset}
+	if !res.Allowed {
+		res.Remaining, res.RetryAfter = 0, reset
+	}
+	return res, nil
+}
+
+var slidingLogScript = db.NewScript(1, `
+local now, window, limit = tonumber(ARGV[1]), tonumber(ARGV[2]), tonumber(ARGV[3])
+redis.call("ZREMRANGEBYSCORE", KEYS[1], "-inf", now - window)
+local n = redis.call("ZCARD", KEYS[1])
+local allowed = 0
+if n < limit then
+	redis.call("ZADD", KEYS[1], now, ARGV[4])
+	n = n + 1
+	allowed = 1
+end
+redis.call("PEXPIRE", KEYS[1], window)
+-- the quota is full again once the newest request leaves the window, and
+-- the next request fits once the oldest one does
+local reset, retry = 0, 0
+local newest = redis.call("ZRANGE", KEYS[1], -1, -1, "WITHSCORES")
+if newest[2] then
+	reset = tonumber(newest[2]) + window - now
+end
+if allowed == 0 then
+	local oldest = redis.call("ZRANGE", KEYS[1], 0, 0, "WITHSCORES")
+	retry = tonumber(oldest[2]) + window - now
+end
+return {allowed, n, reset, retry}`)
+
+// SlidingLog allows Limit requests in any Window long period by keeping the
+// time of every allowed request. It is exact, at the cost of memory
+// proportional to Limit per key.
+type SlidingLog struct {
+	limiter
+	Limit  int
+	Window time.Duration
+}
+
+func NewSlidingLog(r *db.Redis, limit int, window time.Duration, opts ...Option) *SlidingLog {
+	return &SlidingLog{limiter: newLimiter(r, opts), Limit: limit, Window: window}
+}
+
+func (l *SlidingLog) Allow(ctx context.Context, key string) (*Result, error) {
+	member, err := newMember()
+	if err != nil {
+		return nil, err
+	}
+	vals, err := l.run(ctx, slidingLogScript, key, l.nowMs(), db.Millis(l.Window), l.Limit, member)
+	if err != nil {
+		return nil, err
+	}
+	res := &Result{
+		Allowed:   vals[0] == 1,
+		Limit:     l.Limit,
+		Remaining: l.Limit - int(vals[1]),
+		Reset:     fromMs(vals[2]),
+	}
+	if !res.Allowed {
+		res.RetryAfter = fromMs(vals[3])
+	}
+	return res, nil
+}
+
+var tokenBucketScript = db.NewScript(1, `
+local burst, interval, now = tonumber(ARGV[1]), tonumber(ARGV[2]), tonumber(ARGV[3])
+local b = redis.call("HMGET", KEYS[1], "tokens", "ts")
+local tokens, ts = tonumber(b[1]), tonumber(b[2])
+if tokens == nil then
+	tokens, ts = burst, now
+end
+local refill = math.floor((now - ts) / interval)
+if refill > 0 then
+	tokens = math.min(burst, tokens + refill)
+	ts = ts + refill * interval
+end
+if tokens >= burst then
+	ts = now
+end
+local allowed, retry = 0, 0
+if tokens > 0 then
+	tokens = tokens - 1
+	allowed = 1
+else
+	retry = ts + interval - now
+end
+local reset = (burst - tokens) * interval - (now - ts)
+redis.call("HSET", KEYS[1], "tokens", tokens, "ts", ts)
+redis.call("PEXPIRE", KEYS[1], reset + interval)
+return {allowed, tokens, retry, reset}`)
+
+// TokenBucket allows bursts of up to Burst requests and refills one token
+// every Interval.
+type TokenBucket struct {
+	limiter
+	Burst    int
+	Interval time.Duration
+}
+
+func NewTokenBucket(r *db.Redis, burst int, interval time.Duration, opts ...Option) *TokenBucket {
+	return &TokenBucket{limiter: newLimiter(r, opts), Burst: burst, Interval: interval}
+}
+
+func (l *TokenBucket) Allow(ctx context.Context, key string) (*Result, error) {
+	vals, err := l.run(ctx, tokenBucketScript, key, l.Burst, db.Millis(l.Interval), l.nowMs())
+	if err != nil {
+		return nil, err
+	}
+	return &Result{
+		Allowed:    vals[0] == 1,
+		Limit:      l.Burst,
+		Remaining:  int(vals[1]),
+		RetryAfter: fromMs(vals[2]),
+		Reset:      fromMs(vals[3]),
+	}, nil
+}
+
+// newMember returns a unique sorted set member, so requests in the same
+// millisecond are all logged.
+func newMember() (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", errors.Wrap(err, "rate limit can not be checked")
+	}
+	return hex.EncodeToString(b), nil
+}
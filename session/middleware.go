@@ -0,0 +1,69 @@
+package session
+
+import (
+	"context"
+	"github.com/sirupsen/logrus"
+	"net/http"
+)
+
+type contextKey struct{}
+
+// FromContext returns the session Middleware put in ctx, or nil.
+func FromContext(ctx context.Context) *Session {
+	sess, _ := ctx.Value(contextKey{}).(*Session)
+	return sess
+}
+
+// Middleware loads the session of every request into its context and saves
+// it just before the response header is written. If Redis can not be
+// reached the request fails with 503.
+func (s *Store) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sess, err := s.Load(r.Context(), r)
+		if err != nil {
+			logrus.WithError(err).Error("session can not be loaded")
+			http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+			return
+		}
+		sw := &saveWriter{ResponseWriter: w, store: s, sess: sess, ctx: r.Context()}
+		next.ServeHTTP(sw, r.WithContext(context.WithValue(r.Context(), contextKey{}, sess)))
+		sw.save()
+	})
+}
+
+// saveWriter saves the session on the first write, while headers can still
+// be set.
+type saveWriter struct {
+	http.ResponseWriter
+	store *Store
+	sess  *Session
+	ctx   context.Context
+	saved bool
+}
+
+func (w *saveWriter) save() {
+	if w.saved {
+		return
+	}
+	w.saved = true
+	if err := w.store.Save(w.ctx, w.ResponseWriter, w.sess); err != nil {
+		logrus.WithError(err).WithField("session", w.sess.ID()).Error("session can not be saved")
+	}
+}
+
+func (w *saveWriter) WriteHeader(code int) {
+	w.save()
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *saveWriter) Write(b []byte) (int, error) {
+	w.save()
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *saveWriter) Flush() {
+	w.save()
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
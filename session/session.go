@@ -0,0 +1,263 @@
+// Package session keeps HTTP sessions in Redis.
+//
+//	store, err := session.Open(opt, session.Options{Secret: secret})
+//	http.Handle("/", store.Middleware(handler))
+//
+//	func handler(w http.ResponseWriter, r *http.Request) {
+//		sess := session.FromContext(r.Context())
+//		sess.Set("user", "ann")
+//	}
+//
+// The cookie holds a random ID signed with HMAC-SHA256; the data lives in
+// Redis and expires after Options.TTL without requests.
+package session
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"github.com/akikistyle/caplibgo/db"
+	"github.com/garyburd/redigo/redis"
+	"github.com/pkg/errors"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Options configures a Store.
+type Options struct {
+	// Secret signs session IDs. It is required and should be at least 32
+	// random bytes.
+	Secret []byte
+	// TTL is how long a session lives without requests, 30 minutes by
+	// default. Every request extends it.
+	TTL time.Duration
+	// Prefix is put in front of the Redis keys, "session:" by default.
+	Prefix string
+	// Cookie is the template of the session cookie. Name defaults to
+	// "session" and Path to "/". HttpOnly is always set.
+	Cookie http.Cookie
+}
+
+// Store loads and saves sessions. It is safe for concurrent use.
+type Store struct {
+	r    *db.Redis
+	opts Options
+}
+
+// NewStore returns a Store keeping sessions in r.
+func NewStore(r *db.Redis, opts Options) (*Store, error) {
+	if len(opts.Secret) == 0 {
+		return nil, errors.New("session secret is required")
+	}
+	if opts.TTL <= 0 {
+		opts.TTL = 30 * time.Minute
+	}
+	if opts.Prefix == "" {
+		opts.Prefix = "session:"
+	}
+	if opts.Cookie.Name == "" {
+		opts.Cookie.Name = "session"
+	}
+	if opts.Cookie.Path == "" {
+		opts.Cookie.Path = "/"
+	}
+	opts.Cookie.HttpOnly = true
+	return &Store{r: r, opts: opts}, nil
+}
+
+// Open connects to Redis with opt and returns a Store using it.
+func Open(opt *db.DBOpts, opts Options) (*Store, error) {
+	r, err := db.NewRedis(opt)
+	if err != nil {
+		return nil, err
+	}
+	s, err := NewStore(r, opts)
+	if err != nil {
+		r.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// Session is the data of one client. It is not safe for concurrent use.
+type Session struct {
+	id     string
+	oldID  string
+	values map[string]string
+	isNew  bool
+	dirty  bool
+	gone   bool
+}
+
+func (sess *Session) ID() string {
+	return sess.id
+}
+
+// IsNew reports whether the session was created by this request.
+func (sess *Session) IsNew() bool {
+	return sess.isNew
+}
+
+func (sess *Session) Get(key string) string {
+	return sess.values[key]
+}
+
+func (sess *Session) Set(key, val string) {
+	sess.values[key] = val
+	sess.dirty = true
+}
+
+func (sess *Session) Delete(key string) {
+	delete(sess.values, key)
+	sess.dirty = true
+}
+
+// Values returns a copy of the session data.
+func (sess *Session) Values() map[string]string {
+	m := make(map[string]string, len(sess.values))
+	for k, v := range sess.values {
+		m[k] = v
+	}
+	return m
+}
+
+// Regenerate gives the session a new ID and drops the old one when saved.
+// Call it on login and privilege changes to prevent session fixation.
+func (sess *Session) Regenerate() error {
+	id, err := newID()
+	if err != nil {
+		return err
+	}
+	if sess.oldID == "" && !sess.isNew {
+		sess.oldID = sess.id
+	}
+	sess.id = id
+	sess.dirty = true
+	return nil
+}
+
+// Destroy ends the session when saved and expires the cookie.
+func (sess *Session) Destroy() {
+	sess.gone = true
+}
+
+// New returns an empty session with a fresh ID.
+func (s *Store) New() (*Session, error) {
+	id, err := newID()
+	if err != nil {
+		return nil, err
+	}
+	return &Session{id: id, values: make(map[string]string), isNew: true}, nil
+}
+
+// Load returns the session of the request, or a new one if the cookie is
+// missing, badly signed or its session expired. Loading extends the expiry.
+func (s *Store) Load(ctx context.Context, req *http.Request) (*Session, error) {
+	c, err := req.Cookie(s.opts.Cookie.Name)
+	if err != nil {
+		return s.New()
+	}
+	id, ok := s.verify(c.Value)
+	if !ok {
+		return s.New()
+	}
+
+	p := s.r.Pipeline()
+	get := p.Do("GET", s.opts.Prefix+id)
+	p.Do("PEXPIRE", s.opts.Prefix+id, db.Millis(s.opts.TTL))
+	if err := p.Exec(ctx); err != nil {
+		return nil, err
+	}
+	data, err := get.Bytes()
+	if err == db.ErrCacheMiss {
+		return s.New()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	sess := &Session{id: id}
+	if err := json.Unmarshal(data, &sess.values); err != nil {
+		return nil, errors.Wrap(err, "session data is invalid")
+	}
+	if sess.values == nil {
+		sess.values = make(map[string]string)
+	}
+	return sess, nil
+}
+
+// Save writes a changed session to Redis and sets the cookie. It must be
+// called before the response header is written; Middleware does that.
+func (s *Store) Save(ctx context.Context, w http.ResponseWriter, sess *Session) error {
+	if sess.gone {
+		keys := redis.Args{s.opts.Prefix + sess.id}
+		if sess.oldID != "" {
+			keys = keys.Add(s.opts.Prefix + sess.oldID)
+		}
+		if _, err := s.r.Do(ctx, "DEL", keys...); err != nil {
+			return err
+		}
+		c := s.opts.Cookie
+		c.Value, c.MaxAge = "", -1
+		http.SetCookie(w, &c)
+		return nil
+	}
+	if !sess.dirty {
+		if s.opts.Cookie.MaxAge > 0 && !sess.isNew {
+			// a persistent cookie has to slide along with the session
+			http.SetCookie(w, s.cookie(sess))
+		}
+		return nil
+	}
+
+	data, err := json.Marshal(sess.values)
+	if err != nil {
+		return err
+	}
+	err = s.r.Tx(ctx, nil, func(tx *db.Tx) error {
+		if sess.oldID != "" {
+			tx.Queue("DEL", s.opts.Prefix+sess.oldID)
+		}
+		tx.Queue("SET", s.opts.Prefix+sess.id, data, "PX", db.Millis(s.opts.TTL))
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	sess.oldID, sess.isNew, sess.dirty = "", false, false
+	http.SetCookie(w, s.cookie(sess))
+	return nil
+}
+
+func (s *Store) cookie(sess *Session) *http.Cookie {
+	c := s.opts.Cookie
+	c.Value = s.sign(sess.id)
+	return &c
+}
+
+func (s *Store) sign(id string) string {
+	mac := hmac.New(sha256.New, s.opts.Secret)
+	mac.Write([]byte(id))
+	return id + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func (s *Store) verify(value string) (string, bool) {
+	i := strings.LastIndexByte(value, '.')
+	if i < 0 {
+		return "", false
+	}
+	id := value[:i]
+	return id, hmac.Equal([]byte(value), []byte(s.sign(id)))
+}
+
+func newID() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", errors.Wrap(err, "can not generate session ID")
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}